@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// circuitBreaker stops attempts against a Redis target after threshold
+// consecutive failures and lets the next one through once cooldown has
+// passed, so a Redis that is down for long is not hit on every refresh.
+type circuitBreaker struct {
+	failures  int
+	openUntil time.Time
+}
+
+// errCircuitOpen is returned, wrapped, for attempts skipped by an open
+// circuit.
+var errCircuitOpen = errors.New("circuit open")
+
+// allow returns an error wrapping errCircuitOpen while the circuit is open.
+func (b *circuitBreaker) allow(now time.Time) error {
+	if now.Before(b.openUntil) {
+		return fmt.Errorf("%w after %d consecutive failures, next attempt at %s", errCircuitOpen, b.failures, b.openUntil.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// record counts the outcome of an attempt on the target at addr. Reaching
+// threshold failures opens the circuit for cooldown; a failed attempt after
+// the cooldown opens it again right away. A threshold of 0 disables the
+// breaker.
+func (b *circuitBreaker) record(threshold int, cooldown time.Duration, addr string, err error, now time.Time) {
+	if err == nil {
+		if b.failures >= threshold && threshold > 0 {
+			slog.Info("Redis circuit closed", "redis_addr", addr)
+		}
+		b.failures = 0
+		b.openUntil = time.Time{}
+		return
+	}
+
+	b.failures++
+	if threshold > 0 && b.failures >= threshold {
+		b.openUntil = now.Add(cooldown)
+		slog.Warn("Redis circuit open, pausing attempts", "redis_addr", addr, "failures", b.failures, "cooldown", cooldown.String())
+	}
+}
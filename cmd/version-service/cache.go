@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/librescoot/version-service/pkg/versioninfo"
+)
+
+// cachingReader serves identifiers from a cache file when it holds valid
+// values and otherwise reads them from next. Fresh complete reads are saved
+// to the cache since the fused values never change.
+type cachingReader struct {
+	path string
+	// refresh ignores the existing cache and rewrites it from next.
+	refresh bool
+	next    versioninfo.IdentifierReader
+}
+
+// ReadIdentifiers implements versioninfo.IdentifierReader.
+func (r *cachingReader) ReadIdentifiers() (versioninfo.Identifiers, error) {
+	if !r.refresh {
+		ids, err := readIdentifierCache(r.path)
+		if err == nil {
+			slog.Debug("Using cached device identifiers", "path", r.path)
+			return ids, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			slog.Warn("Ignoring identifier cache", "path", r.path, "error", err)
+		}
+	}
+
+	ids, err := r.next.ReadIdentifiers()
+	if err == nil {
+		if cacheErr := writeIdentifierCache(r.path, ids); cacheErr != nil {
+			slog.Warn("Failed to write identifier cache", "path", r.path, "error", cacheErr)
+		}
+	}
+	return ids, err
+}
+
+// readIdentifierCache loads the identifiers saved by writeIdentifierCache.
+// Both values must be well-formed fuse words, so a damaged cache makes the
+// caller read the fuses again. The raw NVMEM words are optional.
+func readIdentifierCache(path string) (versioninfo.Identifiers, error) {
+	ids := versioninfo.Identifiers{CFG0Source: versioninfo.SourceCache, CFG1Source: versioninfo.SourceCache}
+	file, err := os.Open(path)
+	if err != nil {
+		return ids, err
+	}
+	defer file.Close()
+
+	var cfg0Raw, cfg1Raw string
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "cfg0":
+			ids.CFG0 = value
+		case "cfg1":
+			ids.CFG1 = value
+		case "cfg0_raw":
+			cfg0Raw = value
+		case "cfg1_raw":
+			cfg1Raw = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return ids, fmt.Errorf("error reading %s: %w", path, err)
+	}
+
+	for name, value := range map[string]string{"cfg0": ids.CFG0, "cfg1": ids.CFG1} {
+		if _, err := versioninfo.ParseFuseWord(value); err != nil {
+			return ids, fmt.Errorf("%s: malformed %s value %q: %v", path, name, value, err)
+		}
+	}
+	if ids.CFG0Raw, err = decodeCachedWord(cfg0Raw); err != nil {
+		return ids, fmt.Errorf("%s: malformed cfg0_raw value %q", path, cfg0Raw)
+	}
+	if ids.CFG1Raw, err = decodeCachedWord(cfg1Raw); err != nil {
+		return ids, fmt.Errorf("%s: malformed cfg1_raw value %q", path, cfg1Raw)
+	}
+
+	return ids, nil
+}
+
+// decodeCachedWord decodes a raw NVMEM word saved as 8 hex digits; an empty
+// value, for a half not read from NVMEM, gives nil.
+func decodeCachedWord(value string) ([]byte, error) {
+	if value == "" {
+		return nil, nil
+	}
+	word, err := hex.DecodeString(value)
+	if err == nil && len(word) != 4 {
+		err = fmt.Errorf("expected 4 bytes, got %d", len(word))
+	}
+	return word, err
+}
+
+// writeIdentifierCache saves the CFG0/CFG1 hex strings and any raw NVMEM
+// words to path, replacing any previous cache atomically.
+func writeIdentifierCache(path string, ids versioninfo.Identifiers) error {
+	content := fmt.Sprintf("cfg0=%s\ncfg1=%s\n", ids.CFG0, ids.CFG1)
+	if ids.CFG0Raw != nil {
+		content += fmt.Sprintf("cfg0_raw=%x\n", ids.CFG0Raw)
+	}
+	if ids.CFG1Raw != nil {
+		content += fmt.Sprintf("cfg1_raw=%x\n", ids.CFG1Raw)
+	}
+	return writeFileAtomic(path, []byte(content))
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/librescoot/version-service/pkg/versioninfo"
+)
+
+// staticReader returns fixed identifiers and counts its reads.
+type staticReader struct {
+	ids   versioninfo.Identifiers
+	reads int
+}
+
+func (r *staticReader) ReadIdentifiers() (versioninfo.Identifiers, error) {
+	r.reads++
+	return r.ids, nil
+}
+
+func TestReadIdentifierCache(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{"valid", "cfg0=0a1b2c3d\ncfg1=11223344\n", false},
+		{"short word", "cfg0=a1b2c3d\ncfg1=11223344\n", true},
+		{"long word", "cfg0=0a1b2c3d\ncfg1=112233445\n", true},
+		{"sixteen digits", "cfg0=000000000a1b2c3d\ncfg1=11223344\n", true},
+		{"not hex", "cfg0=0a1b2c3d\ncfg1=1122334g\n", true},
+		{"missing", "cfg0=0a1b2c3d\n", true},
+		{"raw words", "cfg0=0a1b2c3d\ncfg1=11223344\ncfg0_raw=3d2c1b0a\ncfg1_raw=44332211\n", false},
+		{"short raw word", "cfg0=0a1b2c3d\ncfg1=11223344\ncfg0_raw=3d2c1b\n", true},
+		{"raw word not hex", "cfg0=0a1b2c3d\ncfg1=11223344\ncfg1_raw=4433221g\n", true},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "identifiers")
+		if err := os.WriteFile(path, []byte(tt.content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := readIdentifierCache(path)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: got error %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestCachingReaderRereadsBadCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "identifiers")
+	if err := os.WriteFile(path, []byte("cfg0=a1b2c3d\ncfg1=11223344\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	next := &staticReader{ids: versioninfo.Identifiers{
+		CFG0: "0a1b2c3d", CFG1: "11223344",
+		CFG0Source: versioninfo.SourceNVMEM, CFG1Source: versioninfo.SourceNVMEM,
+	}}
+	r := &cachingReader{path: path, next: next}
+
+	ids, err := r.ReadIdentifiers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.reads != 1 || ids.Source() != versioninfo.SourceNVMEM {
+		t.Fatalf("bad cache entry used: %d fuse reads, source %s", next.reads, ids.Source())
+	}
+
+	// The fresh read replaced the damaged cache
+	ids, err = r.ReadIdentifiers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.reads != 1 || ids.Source() != versioninfo.SourceCache || ids.CFG0 != "0a1b2c3d" {
+		t.Errorf("rewritten cache not used: %d fuse reads, %+v", next.reads, ids)
+	}
+}
+
+func TestIdentifierCacheRawWords(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "identifiers")
+	ids := versioninfo.Identifiers{CFG0: "01020304", CFG1: "05060708", CFG0Raw: []byte{1, 2, 3, 4}}
+	if err := writeIdentifierCache(path, ids); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readIdentifierCache(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.CFG0 != ids.CFG0 || got.CFG1 != ids.CFG1 || !bytes.Equal(got.CFG0Raw, ids.CFG0Raw) || got.CFG1Raw != nil {
+		t.Errorf("got %+v, want %+v", got, ids)
+	}
+	if got.Source() != versioninfo.SourceCache {
+		t.Errorf("source %q, want %q", got.Source(), versioninfo.SourceCache)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/librescoot/version-service/pkg/versioninfo"
+	"github.com/redis/go-redis/v9"
+)
+
+// runCompare computes the current fields and compares them with the hashes
+// stored in Redis without writing anything. Differences are printed one per
+// line, and the returned exit code is exitCompareDiff if there are any.
+func runCompare(ctx context.Context, cfg *config, reader versioninfo.IdentifierReader) int {
+	res, err := collectFields(cfg, reader)
+	if err != nil {
+		fatal("Failed to read OS release information", "error", err)
+	}
+
+	// Every target has to be compared, so all of them must be reachable
+	cfg.redisRequireAll = true
+	conns, err := connectRedisTargets(ctx, cfg)
+	if err != nil {
+		fatal("Failed to connect to Redis", "redis_addr", cfg.redisTarget(), "error", err)
+	}
+	defer closeRedisTargets(conns)
+
+	code := 0
+	for _, conn := range conns {
+		for _, h := range redisHashes(cfg, res) {
+			stored, err := readStoredFields(ctx, conn.rdb, cfg, h.name)
+			if err != nil {
+				fatal("Failed to read Redis hash", "hash", h.name, "redis_addr", conn.addr, "error", err)
+			}
+
+			diffs := diffFields(stored, h.fields)
+			for _, line := range diffs {
+				if cfg.serialHash != "" {
+					line = h.name + " " + line
+				}
+				if len(conns) > 1 {
+					line = conn.addr + " " + line
+				}
+				fmt.Println(line)
+			}
+			if len(diffs) > 0 {
+				code = exitCompareDiff
+			}
+		}
+	}
+	return code
+}
+
+// readStoredFields returns the fields stored under name: the hash, or in
+// -redis-key-mode keys the name:field string keys.
+func readStoredFields(ctx context.Context, rdb redis.UniversalClient, cfg *config, name string) (map[string]string, error) {
+	if cfg.redisKeyMode != "keys" {
+		return rdb.HGetAll(ctx, name).Result()
+	}
+
+	keys, err := scanFieldKeys(ctx, rdb, name)
+	if err != nil {
+		return nil, err
+	}
+	stored := make(map[string]string)
+	for _, key := range keys {
+		value, err := rdb.Get(ctx, key).Result()
+		if errors.Is(err, redis.Nil) {
+			continue // expired since the scan
+		}
+		if err != nil {
+			return nil, err
+		}
+		stored[strings.TrimPrefix(key, name+":")] = value
+	}
+	return stored, nil
+}
+
+// diffFields lists how stored differs from current: "~" marks a field whose
+// value changed, "-" a field missing from stored and "+" an extra field in
+// stored. Current fields come first in their own order, then extra fields
+// sorted by name. last_updated and uptime_seconds differ on every run and
+// are not compared.
+func diffFields(stored map[string]string, current *fieldSet) []string {
+	var diffs []string
+	current.each(func(key, value string) {
+		if key == "last_updated" || key == "uptime_seconds" {
+			return
+		}
+		storedValue, ok := stored[key]
+		switch {
+		case !ok:
+			diffs = append(diffs, fmt.Sprintf("- %s: missing, current %q", key, value))
+		case storedValue != value:
+			diffs = append(diffs, fmt.Sprintf("~ %s: stored %q, current %q", key, storedValue, value))
+		}
+	})
+
+	var extra []string
+	for key := range stored {
+		if _, ok := current.get(key); !ok {
+			extra = append(extra, key)
+		}
+	}
+	sort.Strings(extra)
+	for _, key := range extra {
+		diffs = append(diffs, fmt.Sprintf("+ %s: extra, stored %q", key, stored[key]))
+	}
+	return diffs
+}
@@ -0,0 +1,772 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/librescoot/version-service/pkg/versioninfo"
+	"github.com/redis/go-redis/v9"
+)
+
+// envPrefix prefixes the environment variables that mirror each flag.
+const envPrefix = "VERSIONSERVICE_"
+
+// envNameOverrides holds environment variable names that do not follow the
+// plain flag-name mapping.
+var envNameOverrides = map[string]string{
+	"redis": envPrefix + "REDIS_ADDR",
+}
+
+// config holds the command-line options.
+type config struct {
+	configFile           string
+	redisAddr            string
+	redisURL             string
+	redisRequireAll      bool
+	hashName             string
+	namespace            string
+	redisKeyMode         string
+	redisKeyPrefix       string
+	redisPassword        string
+	redisPasswordFile    string
+	redisDB              int
+	redisClientName      string
+	redisTLS             bool
+	redisCACert          string
+	redisClientCert      string
+	redisClientKey       string
+	redisTLSSkipVerify   bool
+	connectTimeout       time.Duration
+	connectRetryInterval time.Duration
+	redisOpRetries       int
+	sentinelAddrList     string
+	clusterAddrList      string
+	masterName           string
+	redisOpBackoff       time.Duration
+	redisPingInterval    time.Duration
+	breakerThreshold     int
+	breakerCooldown      time.Duration
+	osReleasePath        string
+	soc                  string
+	nvmemPath            string
+	otpCfg0Path          string
+	otpCfg1Path          string
+	nvmemByteOrder       string
+	nvmemRejectValues    string
+	nvmemRetries         int
+	fuseMap              string
+	includeUname         bool
+	includeUptime        bool
+	kernelReleasePath    string
+	uptimePath           string
+	waitForNVMEM         time.Duration
+	disableOTPFallback   bool
+	enableDTFallback     bool
+	dtSerialPath         string
+	eepromPath           string
+	eepromOffset         int
+	eepromLength         int
+	eepromMode           string
+	identifierTimeout    time.Duration
+	fieldList            string
+	fieldPrefix          string
+	fieldTransform       string
+	fieldRename          string
+	preserveKeyCase      bool
+	maxFieldBytes        int
+	oversizedFieldAction string
+	staticFields         stringList
+	jsonBlobField        string
+	jsonBlobMode         string
+	prefixSerialFields   bool
+	storeFieldSource     bool
+	noOverwrite          bool
+	noOverwriteSerial    bool
+	serialHash           string
+	versionCompareKey    string
+	timestampFormat      string
+	output               string
+	mqttBroker           string
+	reportURL            string
+	reportAuthHeader     string
+	outputFile           string
+	mqttTopic            string
+	mqttUsername         string
+	mqttPassword         string
+	notifyChannel        string
+	dryRun               bool
+	ttl                  time.Duration
+	interval             time.Duration
+	watch                bool
+	fullWrites           bool
+	verifyWrites         bool
+	metricsAddr          string
+	healthAddr           string
+	grpcAddr             string
+	logFormat            string
+	logLevel             string
+	quiet                bool
+	strict               bool
+	onceCheck            bool
+	compare              bool
+	selftest             bool
+	reset                bool
+	yes                  bool
+	printConfig          bool
+	printConfigFormat    string
+
+	identifierCache        string
+	identifierCacheRefresh bool
+	allowZeroSerial        bool
+	noSerial               bool
+	verifySerialChecksum   string
+	legacySerialMode       string
+	legacySerialBase       int
+	realSerialOrder        string
+	serialHexCase          string
+	serialFormat           string
+	serialDisplayFormat    string
+	includeSerialRaw       bool
+	showVersion            bool
+
+	// layout is the OCOTP layout resolved from soc and the path overrides.
+	layout versioninfo.Layout
+	// fuses are the extra NVMEM fields parsed from fuseMap.
+	fuses []fuseField
+	// redisAddrs is redisAddr split on commas.
+	redisAddrs []string
+	// redisURLOptions are the client options parsed from redisURL.
+	redisURLOptions *redis.Options
+	// sentinelAddrs is sentinelAddrList split on commas.
+	sentinelAddrs []string
+	// clusterAddrs is clusterAddrList split on commas.
+	clusterAddrs []string
+	// fieldAllowlist is fieldList as a set of lowercase os-release keys.
+	fieldAllowlist map[string]bool
+	// transforms are the per-key value transforms parsed from fieldTransform.
+	transforms map[string][]func(string) string
+	// renames maps os-release keys to the field names from fieldRename.
+	renames map[string]string
+	// extraFields are the static key=value pairs from staticFields.
+	extraFields *fieldSet
+	// outputs is the set of destinations selected by output and mqttBroker.
+	outputs map[string]bool
+	// setFlags holds the names of the flags given on the command line.
+	setFlags map[string]bool
+}
+
+// parseFlags registers and parses the command-line flags, then fills in
+// options not given on the command line from the environment and -config.
+// Precedence is command line, then environment, then config file, then the
+// built-in default.
+func parseFlags() (*config, error) {
+	cfg := &config{}
+	flag.StringVar(&cfg.configFile, "config", "", "TOML file setting any of these options by flag name; command-line flags take precedence")
+	flag.StringVar(&cfg.redisAddr, "redis", "192.168.7.1:6379", "Redis server address, or a comma-separated list to write to several servers")
+	flag.BoolVar(&cfg.redisRequireAll, "redis-require-all", false, "With several -redis addresses, fail if any of them cannot be written instead of only warning")
+	flag.StringVar(&cfg.redisURL, "redis-url", "", "Redis connection URL (redis:// or rediss://), taking precedence over -redis, -redis-password, -redis-db and -redis-tls")
+	flag.StringVar(&cfg.hashName, "hash", "os-release", "Redis hash name to store the values")
+	flag.StringVar(&cfg.namespace, "namespace", "", "Prefix the Redis hash and key names with NAMESPACE: to keep fleets sharing a Redis apart (none when empty)")
+	flag.StringVar(&cfg.redisKeyMode, "redis-key-mode", "hash", "How fields are stored in Redis: hash, or keys for one PREFIX:field string key per field")
+	flag.StringVar(&cfg.redisKeyPrefix, "redis-key-prefix", "", "Key prefix in -redis-key-mode keys (default: the -hash name)")
+	flag.StringVar(&cfg.redisPassword, "redis-password", "", "Redis password (overrides REDIS_PASSWORD)")
+	flag.StringVar(&cfg.redisPasswordFile, "redis-password-file", "", "File to read the Redis password from")
+	flag.IntVar(&cfg.redisDB, "redis-db", 0, "Redis logical database index (0-15)")
+	flag.StringVar(&cfg.redisClientName, "redis-client-name", "version-service", "Connection name set with CLIENT SETNAME, shown in CLIENT LIST (none when empty)")
+	flag.BoolVar(&cfg.redisTLS, "redis-tls", false, "Connect to Redis using TLS")
+	flag.StringVar(&cfg.redisCACert, "redis-ca-cert", "", "CA certificate file used to verify the Redis server")
+	flag.StringVar(&cfg.redisClientCert, "redis-client-cert", "", "Client certificate file for Redis TLS authentication")
+	flag.StringVar(&cfg.redisClientKey, "redis-client-key", "", "Client key file for Redis TLS authentication")
+	flag.BoolVar(&cfg.redisTLSSkipVerify, "redis-tls-skip-verify", false, "Skip Redis server certificate verification (insecure)")
+	flag.DurationVar(&cfg.connectTimeout, "redis-connect-timeout", 0, "Keep retrying the initial Redis connection for this long (0 tries once)")
+	flag.DurationVar(&cfg.connectRetryInterval, "redis-connect-retry-interval", time.Second, "Delay between Redis connection attempts")
+	flag.StringVar(&cfg.sentinelAddrList, "redis-sentinel-addrs", "", "Comma-separated Redis Sentinel addresses; connects to the master they report")
+	flag.StringVar(&cfg.clusterAddrList, "redis-cluster-addrs", "", "Comma-separated Redis Cluster node addresses; connects to the cluster instead of a single server")
+	flag.StringVar(&cfg.masterName, "redis-master-name", "", "Master name to ask the Sentinels for (required with -redis-sentinel-addrs)")
+	flag.IntVar(&cfg.redisOpRetries, "redis-op-retries", 0, "Retries for each failed Redis write before giving up")
+	flag.DurationVar(&cfg.redisOpBackoff, "redis-op-backoff", 200*time.Millisecond, "Initial delay between Redis write retries, doubled on each retry")
+	flag.DurationVar(&cfg.redisPingInterval, "redis-ping-interval", 0, "With -interval or -watch, PING Redis at this interval to notice a lost connection before the next write (0 disables)")
+	flag.IntVar(&cfg.breakerThreshold, "redis-breaker-threshold", 5, "With -interval or -watch, stop contacting a Redis target after this many consecutive failed writes (0 disables)")
+	flag.DurationVar(&cfg.breakerCooldown, "redis-breaker-cooldown", time.Minute, "How long a Redis target is left alone once -redis-breaker-threshold is reached")
+	flag.StringVar(&cfg.osReleasePath, "os-release-path", versioninfo.DefaultOSReleasePath, "Path to the os-release file")
+	flag.StringVar(&cfg.soc, "soc", "imx6", "SoC family selecting the OCOTP layout: imx6 or imx8mm")
+	flag.StringVar(&cfg.nvmemPath, "nvmem-path", "", "Override the OCOTP NVMEM device path")
+	flag.StringVar(&cfg.otpCfg0Path, "otp-cfg0-path", "", "Override the OTP sysfs path for CFG0")
+	flag.StringVar(&cfg.otpCfg1Path, "otp-cfg1-path", "", "Override the OTP sysfs path for CFG1")
+	flag.StringVar(&cfg.fieldList, "fields", "", "Comma-separated os-release keys to store (all when empty)")
+	flag.IntVar(&cfg.maxFieldBytes, "max-field-bytes", 64*1024, "Longest os-release value stored, in bytes")
+	flag.StringVar(&cfg.oversizedFieldAction, "oversized-field-action", "truncate", "What to do with an os-release value over -max-field-bytes: truncate or skip")
+	flag.BoolVar(&cfg.preserveKeyCase, "preserve-key-case", false, "Store os-release keys exactly as written in the file, e.g. VERSION_ID, instead of lowercasing them")
+	flag.StringVar(&cfg.fieldPrefix, "field-prefix", "", "Prefix added to os-release field names, e.g. osrelease_")
+	flag.StringVar(&cfg.fieldRename, "hash-field-rename", "", "Comma-separated os-release key renames as key=newkey, e.g. version_id=os_version")
+	flag.StringVar(&cfg.fieldTransform, "field-transform", "", "Comma-separated os-release value transforms as key=trim|lower|upper, chained with +, e.g. id=lower,version_codename=trim+lower")
+	flag.StringVar(&cfg.jsonBlobField, "json-blob-field", "", "Also store all os-release fields as one JSON object with sorted keys in this field, e.g. os_release_json (disabled when empty)")
+	flag.StringVar(&cfg.jsonBlobMode, "json-blob-mode", "both", "With -json-blob-field, store the os-release fields both individually and as JSON, or only as JSON: both or only")
+	flag.Var(&cfg.staticFields, "set", "Extra static field to store as key=value, e.g. batch=2024-07; repeatable")
+	flag.BoolVar(&cfg.prefixSerialFields, "field-prefix-serial", false, "Apply -field-prefix to the serial number fields too")
+	flag.StringVar(&cfg.serialHash, "serial-hash", "", "Redis hash to store the serial number fields in instead of -hash (same hash when empty)")
+	flag.BoolVar(&cfg.noOverwrite, "no-overwrite", false, "Only set os-release and other non-serial fields that don't exist in Redis yet")
+	flag.BoolVar(&cfg.noOverwriteSerial, "no-overwrite-serial", false, "Only set serial number fields that don't exist in Redis yet")
+	flag.BoolVar(&cfg.storeFieldSource, "hash-per-field-source", false, "Also store serial_cfg0_source and serial_cfg1_source naming where each identifier was read from (nvmem, otp, eeprom, devicetree or cache)")
+	flag.StringVar(&cfg.timestampFormat, "timestamp-format", "rfc3339", "Format of the last_updated field: rfc3339 or epoch")
+	flag.StringVar(&cfg.versionCompareKey, "version-compare-key", "image_version", "os-release key compared against the service version to set version_mismatch (disabled when empty)")
+	flag.StringVar(&cfg.nvmemByteOrder, "nvmem-byte-order", "le", "Byte order of the NVMEM fuse words: le or be")
+	flag.StringVar(&cfg.nvmemRejectValues, "nvmem-reject-values", "", "Comma-separated NVMEM fuse words treated as a marginal read and re-read, e.g. ffffffff,00000000 (none when empty)")
+	flag.IntVar(&cfg.nvmemRetries, "nvmem-retries", 2, "How often a word in -nvmem-reject-values is re-read before falling back to OTP")
+	flag.DurationVar(&cfg.waitForNVMEM, "wait-for-nvmem", 0, "Wait up to this long for the NVMEM device to appear before falling back to OTP")
+	flag.BoolVar(&cfg.disableOTPFallback, "disable-otp-fallback", false, "Only read the identifiers from NVMEM, never from the OTP sysfs files")
+	flag.BoolVar(&cfg.enableDTFallback, "enable-dt-fallback", false, "Fall back to the devicetree serial number for identifier parts that NVMEM and OTP could not provide")
+	flag.StringVar(&cfg.dtSerialPath, "dt-serial-path", versioninfo.DefaultDTSerialPath, "Devicetree property read by -enable-dt-fallback")
+	flag.StringVar(&cfg.eepromPath, "eeprom-path", "", "EEPROM holding the unique ID, e.g. /sys/bus/i2c/devices/0-0050/eeprom (disabled when empty)")
+	flag.IntVar(&cfg.eepromOffset, "eeprom-offset", 0, "Byte offset of the unique ID in -eeprom-path")
+	flag.IntVar(&cfg.eepromLength, "eeprom-length", 8, "Length of the unique ID in -eeprom-path in bytes (1-8)")
+	flag.StringVar(&cfg.eepromMode, "eeprom-mode", "fallback", "When -eeprom-path is read: primary, before the fuses, or fallback, after OTP")
+	flag.DurationVar(&cfg.identifierTimeout, "identifier-read-timeout", 0, "Give up on a single NVMEM or OTP read after this long (0 waits forever)")
+	flag.StringVar(&cfg.fuseMap, "fuse-map", "", "Extra NVMEM ranges to store as hex fields, e.g. mac:offset=0x24,len=6;flags:offset=0x10,len=4")
+	flag.BoolVar(&cfg.includeUname, "include-uname", false, "Also store the running kernel release as kernel_version")
+	flag.BoolVar(&cfg.includeUptime, "include-uptime", false, "Also store the seconds since boot as uptime_seconds")
+	flag.StringVar(&cfg.kernelReleasePath, "kernel-release-path", defaultKernelReleasePath, "File -include-uname reads the kernel release from")
+	flag.StringVar(&cfg.uptimePath, "uptime-path", defaultUptimePath, "File -include-uptime reads the uptime from")
+	flag.StringVar(&cfg.output, "output", "redis", "Comma-separated output destinations: redis, json (stdout), yaml (stdout), mqtt, file; both means redis,json")
+	flag.StringVar(&cfg.mqttBroker, "mqtt-broker", "", "MQTT broker address (host:port) to publish the values to as a retained message")
+	flag.StringVar(&cfg.outputFile, "output-file", "", "File to write the values to as JSON, replaced atomically")
+	flag.StringVar(&cfg.reportURL, "report-url", "", "URL to POST the serial numbers and os-release version to as JSON, e.g. a provisioning server (disabled when empty)")
+	flag.StringVar(&cfg.reportAuthHeader, "report-auth-header", "", "Header sent with the -report-url request as Name: value, e.g. \"Authorization: Bearer TOKEN\"")
+	flag.StringVar(&cfg.mqttTopic, "mqtt-topic", "librescoot/version", "MQTT topic for the retained version message")
+	flag.StringVar(&cfg.mqttUsername, "mqtt-username", "", "MQTT username")
+	flag.StringVar(&cfg.mqttPassword, "mqtt-password", "", "MQTT password")
+	flag.StringVar(&cfg.notifyChannel, "notify-channel", "", "Redis channel to PUBLISH an update notification to after writing")
+	flag.BoolVar(&cfg.dryRun, "dry-run", false, "Connect to Redis and compute all values, but only log what would be written")
+	flag.DurationVar(&cfg.ttl, "ttl", 0, "Expire the Redis hash after this duration (0 keeps it persistent)")
+	flag.DurationVar(&cfg.interval, "interval", 0, "Keep running and refresh the values at this interval (0 runs once)")
+	flag.BoolVar(&cfg.watch, "watch", false, "Keep running and refresh the values whenever the os-release file changes (polls at -interval, or every minute, if inotify is unavailable)")
+	flag.BoolVar(&cfg.fullWrites, "full-writes", false, "With -interval or -watch, rewrite every field on each refresh instead of only the changed ones")
+	flag.BoolVar(&cfg.verifyWrites, "verify-writes", false, "Read the fields back after writing and fail if any is missing or differs")
+	flag.StringVar(&cfg.metricsAddr, "metrics-addr", "", "Address to serve Prometheus metrics on, e.g. :9100 (disabled when empty)")
+	flag.StringVar(&cfg.healthAddr, "health-addr", "", "Address to serve /healthz and /readyz on (disabled when empty)")
+	flag.StringVar(&cfg.grpcAddr, "grpc-addr", "", "Address to serve the GetVersionInfo gRPC service on (disabled when empty)")
+	flag.StringVar(&cfg.verifySerialChecksum, "verify-serial-checksum", "", "Warn if serial_number_real fails this checksum: luhn16 (disabled when empty)")
+	flag.StringVar(&cfg.legacySerialMode, "legacy-serial-mode", "sum", "Encoding of serial_number: sum, concat-decimal or disabled")
+	flag.IntVar(&cfg.legacySerialBase, "legacy-serial-base", 10, "Base serial_number is stored in: 10 or 16")
+	flag.StringVar(&cfg.realSerialOrder, "real-serial-order", "cfg1cfg0", "Concatenation order of serial_number_real: cfg1cfg0 or cfg0cfg1")
+	flag.StringVar(&cfg.serialHexCase, "serial-hex-case", "lower", "Letter case of serial_number_real and serial_cfg0/serial_cfg1: lower or upper")
+	flag.StringVar(&cfg.serialFormat, "serial-format", "", "Format for an extra serial_number_formatted field, e.g. %012d for the legacy serial or %016.4X for the real serial grouped with dashes (disabled when empty)")
+	flag.BoolVar(&cfg.includeSerialRaw, "include-serial-raw", false, "Also store serial_number_raw, the base64 of the 8 little-endian unique ID bytes")
+	flag.StringVar(&cfg.serialDisplayFormat, "serial-display-format", "XXXX-XXXX-XXXX-XXXX", "Mask for the serial_number_display field, each X taking the next digit of serial_number_real (disabled when empty)")
+	flag.StringVar(&cfg.logFormat, "log-format", "text", "Log output format: text or json")
+	flag.StringVar(&cfg.logLevel, "log-level", "info", "Minimum log level: debug, info, warn or error")
+	flag.BoolVar(&cfg.quiet, "quiet", false, "Only log warnings and errors (shorthand for -log-level warn)")
+	flag.BoolVar(&cfg.strict, "strict", false, "Exit non-zero if the device identifiers or serial numbers could not be stored")
+	flag.BoolVar(&cfg.onceCheck, "once-check", false, "Print the device serial numbers as key=value lines and exit, without Redis")
+	flag.BoolVar(&cfg.compare, "compare", false, "Compare the stored hash with the current values, print the differences and exit without writing")
+	flag.BoolVar(&cfg.selftest, "selftest", false, "Probe os-release, NVMEM, OTP, serial computation and Redis, print PASS/FAIL for each and exit without writing")
+	flag.BoolVar(&cfg.reset, "reset", false, "Delete the stored hash, and -serial-hash if set, from Redis and exit; requires -yes")
+	flag.BoolVar(&cfg.yes, "yes", false, "Confirm -reset")
+	flag.BoolVar(&cfg.printConfig, "print-config", false, "Print the effective configuration from flags, environment and -config with secrets masked, then exit")
+	flag.StringVar(&cfg.printConfigFormat, "print-config-format", "text", "Format of -print-config: text or json")
+	flag.StringVar(&cfg.identifierCache, "identifier-cache", "", "File caching the device identifiers between runs (disabled when empty)")
+	flag.BoolVar(&cfg.identifierCacheRefresh, "identifier-cache-refresh", false, "Ignore the identifier cache, re-read the fuses and rewrite it")
+	flag.BoolVar(&cfg.allowZeroSerial, "allow-zero-serial", false, "Accept all-zero CFG0/CFG1 values as a valid identity instead of treating the board as unprovisioned")
+	flag.BoolVar(&cfg.noSerial, "no-serial", false, "Do not read the device identifiers or store serial numbers, only os-release")
+	flag.BoolVar(&cfg.showVersion, "version", false, "Print version and exit")
+	flag.Parse()
+
+	// Printing the version must work even with a broken environment or
+	// config file
+	if cfg.showVersion {
+		return cfg, nil
+	}
+
+	cfg.setFlags = make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		cfg.setFlags[f.Name] = true
+	})
+
+	if err := applyEnv(cfg.setFlags); err != nil {
+		return nil, err
+	}
+
+	if cfg.configFile != "" {
+		if err := applyConfigFile(cfg.configFile, cfg.setFlags); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.quiet {
+		cfg.logLevel = "warn"
+	}
+	return cfg, nil
+}
+
+// envName returns the environment variable mirroring the flag name, e.g.
+// VERSIONSERVICE_OS_RELEASE_PATH for -os-release-path.
+func envName(name string) string {
+	if env, ok := envNameOverrides[name]; ok {
+		return env
+	}
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// applyEnv sets every flag not given on the command line whose environment
+// variable is set, and marks it in setFlags.
+func applyEnv(setFlags map[string]bool) error {
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		if err != nil || setFlags[f.Name] {
+			return
+		}
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok {
+			return
+		}
+		if list, ok := f.Value.(*stringList); ok {
+			// One variable holds every entry as a comma-separated list
+			list.setAll(splitList(value))
+			setFlags[f.Name] = true
+			return
+		}
+		if setErr := f.Value.Set(value); setErr != nil {
+			err = fmt.Errorf("invalid value for %s: %v", envName(f.Name), setErr)
+			return
+		}
+		setFlags[f.Name] = true
+	})
+	return err
+}
+
+// secretFlags are the flags whose values -print-config masks.
+var secretFlags = map[string]bool{
+	"redis-password": true,
+	"mqtt-password":  true,
+}
+
+// printConfig writes the value of every flag after the environment and the
+// config file have been applied, as name=value lines or a JSON object.
+// Passwords, the value of -report-auth-header and passwords in URLs are
+// masked.
+func printConfig(w io.Writer, format string) error {
+	values := make(map[string]string)
+	var lines []string
+	flag.VisitAll(func(f *flag.Flag) {
+		value := maskedFlagValue(f.Name, f.Value.String())
+		values[f.Name] = value
+		lines = append(lines, f.Name+"="+value)
+	})
+
+	switch format {
+	case "text":
+		_, err := fmt.Fprintln(w, strings.Join(lines, "\n"))
+		return err
+	case "json":
+		data, err := json.MarshalIndent(values, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(data))
+		return err
+	default:
+		return fmt.Errorf("-print-config-format %q must be text or json", format)
+	}
+}
+
+// maskedFlagValue returns value with any secret in it replaced by "xxxxx".
+func maskedFlagValue(name, value string) string {
+	switch {
+	case value == "":
+		return value
+	case secretFlags[name]:
+		return "xxxxx"
+	case name == "report-auth-header":
+		header, _, _ := strings.Cut(value, ":")
+		return header + ": xxxxx"
+	case strings.Contains(value, "://"):
+		// Connection URLs such as -redis-url may carry a password
+		u, err := url.Parse(value)
+		if err != nil {
+			return "xxxxx"
+		}
+		return u.Redacted()
+	}
+	return value
+}
+
+// osReleaseOptions returns the os-release parsing options.
+func (c *config) osReleaseOptions() versioninfo.OSReleaseOptions {
+	return versioninfo.OSReleaseOptions{
+		PreserveCase:  c.preserveKeyCase,
+		MaxValueBytes: c.maxFieldBytes,
+		SkipOversized: c.oversizedFieldAction == "skip",
+	}
+}
+
+// validate checks option values and resolves derived settings.
+func (c *config) validate() error {
+	if c.redisDB < 0 || c.redisDB > 15 {
+		return fmt.Errorf("-redis-db %d must be between 0 and 15", c.redisDB)
+	}
+
+	c.sentinelAddrs = splitList(c.sentinelAddrList)
+	if (len(c.sentinelAddrs) > 0) != (c.masterName != "") {
+		return fmt.Errorf("-redis-sentinel-addrs and -redis-master-name must be specified together")
+	}
+	if len(c.sentinelAddrs) > 0 && c.setFlags["redis"] {
+		return fmt.Errorf("-redis cannot be combined with -redis-sentinel-addrs; the Sentinels provide the master address")
+	}
+
+	c.redisAddrs = splitList(c.redisAddr)
+	if len(c.redisAddrs) > 1 {
+		if c.redisURL != "" || len(c.sentinelAddrs) > 0 || c.clusterAddrList != "" {
+			return fmt.Errorf("several -redis addresses cannot be combined with -redis-url, -redis-sentinel-addrs or -redis-cluster-addrs")
+		}
+	}
+
+	c.clusterAddrs = splitList(c.clusterAddrList)
+	if len(c.clusterAddrs) > 0 {
+		switch {
+		case c.setFlags["redis"], c.redisURL != "", len(c.sentinelAddrs) > 0:
+			return fmt.Errorf("-redis-cluster-addrs cannot be combined with -redis, -redis-url or -redis-sentinel-addrs")
+		case c.redisDB != 0:
+			return fmt.Errorf("-redis-db is not supported with -redis-cluster-addrs; Redis Cluster only has database 0")
+		}
+	}
+
+	if c.redisURL != "" {
+		if len(c.sentinelAddrs) > 0 {
+			return fmt.Errorf("-redis-url cannot be combined with -redis-sentinel-addrs")
+		}
+		opts, err := redis.ParseURL(c.redisURL)
+		if err != nil {
+			return fmt.Errorf("-redis-url: %w", err)
+		}
+		c.redisURLOptions = opts
+	}
+
+	if c.maxFieldBytes < 1 {
+		return fmt.Errorf("-max-field-bytes must be positive")
+	}
+	if c.oversizedFieldAction != "truncate" && c.oversizedFieldAction != "skip" {
+		return fmt.Errorf("-oversized-field-action %q must be truncate or skip", c.oversizedFieldAction)
+	}
+
+	layout, ok := versioninfo.SoCLayouts[c.soc]
+	if !ok {
+		return fmt.Errorf("-soc %q must be one of imx6, imx8mm", c.soc)
+	}
+	if c.nvmemPath != "" {
+		layout.NVMEMPath = c.nvmemPath
+	}
+	if c.otpCfg0Path != "" {
+		layout.OTPCFG0Path = c.otpCfg0Path
+	}
+	if c.otpCfg1Path != "" {
+		layout.OTPCFG1Path = c.otpCfg1Path
+	}
+	switch c.nvmemByteOrder {
+	case "le":
+	case "be":
+		layout.BigEndian = true
+	default:
+		return fmt.Errorf("-nvmem-byte-order %q must be le or be", c.nvmemByteOrder)
+	}
+	for _, value := range splitList(c.nvmemRejectValues) {
+		value = strings.TrimPrefix(strings.ToLower(value), "0x")
+		if _, err := versioninfo.ParseFuseWord(value); err != nil {
+			return fmt.Errorf("-nvmem-reject-values %q: %w", value, err)
+		}
+		layout.RejectValues = append(layout.RejectValues, value)
+	}
+	if c.nvmemRetries < 0 {
+		return fmt.Errorf("-nvmem-retries must not be negative")
+	}
+	layout.Retries = c.nvmemRetries
+	layout.NoOTP = c.disableOTPFallback
+	if c.enableDTFallback {
+		layout.DTSerialPath = c.dtSerialPath
+	}
+	if c.eepromPath != "" {
+		if c.eepromOffset < 0 {
+			return fmt.Errorf("-eeprom-offset must not be negative")
+		}
+		if c.eepromLength < 1 || c.eepromLength > 8 {
+			return fmt.Errorf("-eeprom-length %d must be between 1 and 8", c.eepromLength)
+		}
+		switch c.eepromMode {
+		case "primary":
+			layout.EEPROMPrimary = true
+		case "fallback":
+		default:
+			return fmt.Errorf("-eeprom-mode %q must be primary or fallback", c.eepromMode)
+		}
+		layout.EEPROMPath = c.eepromPath
+		layout.EEPROMOffset = c.eepromOffset
+		layout.EEPROMLength = c.eepromLength
+	}
+	if c.identifierTimeout < 0 {
+		return fmt.Errorf("-identifier-read-timeout must not be negative")
+	}
+	layout.ReadTimeout = c.identifierTimeout
+	c.layout = layout
+
+	fuses, err := parseFuseMap(c.fuseMap)
+	if err != nil {
+		return fmt.Errorf("-fuse-map: %w", err)
+	}
+	c.fuses = fuses
+
+	c.fieldAllowlist = make(map[string]bool)
+	for _, key := range splitList(c.fieldList) {
+		c.fieldAllowlist[strings.ToLower(key)] = true
+	}
+
+	c.versionCompareKey = strings.ToLower(c.versionCompareKey)
+
+	transforms, err := parseFieldTransforms(c.fieldTransform)
+	if err != nil {
+		return fmt.Errorf("-field-transform: %w", err)
+	}
+	c.transforms = transforms
+
+	renames, err := parseFieldRenames(c.fieldRename)
+	if err != nil {
+		return fmt.Errorf("-hash-field-rename: %w", err)
+	}
+	c.renames = renames
+	// A selected key that keeps its name would be overwritten by the rename
+	for key, newKey := range renames {
+		if _, renamed := renames[strings.ToLower(newKey)]; c.fieldAllowlist[strings.ToLower(newKey)] && !renamed {
+			return fmt.Errorf("-hash-field-rename: %q renamed to %q, which -fields also stores", key, newKey)
+		}
+	}
+
+	switch c.jsonBlobMode {
+	case "both", "only":
+	default:
+		return fmt.Errorf("-json-blob-mode %q must be both or only", c.jsonBlobMode)
+	}
+
+	extraFields, err := parseStaticFields(c.staticFields)
+	if err != nil {
+		return fmt.Errorf("-set: %w", err)
+	}
+	c.extraFields = extraFields
+
+	c.outputs = make(map[string]bool)
+	for _, out := range splitList(c.output) {
+		switch out {
+		case "redis", "json", "yaml", "mqtt", "file":
+			c.outputs[out] = true
+		case "both":
+			c.outputs["redis"] = true
+			c.outputs["json"] = true
+		default:
+			return fmt.Errorf("-output %q: unknown destination %q (must be redis, json, yaml, mqtt, file or both)", c.output, out)
+		}
+	}
+	if c.mqttBroker != "" {
+		c.outputs["mqtt"] = true
+	}
+	if c.outputs["mqtt"] && c.mqttBroker == "" {
+		return fmt.Errorf("-output mqtt requires -mqtt-broker")
+	}
+	// MQTT 3.1.1 only allows a password together with a user name
+	if c.mqttPassword != "" && c.mqttUsername == "" {
+		return fmt.Errorf("-mqtt-password requires -mqtt-username")
+	}
+	if c.outputFile != "" {
+		c.outputs["file"] = true
+	}
+	if c.outputs["file"] && c.outputFile == "" {
+		return fmt.Errorf("-output file requires -output-file")
+	}
+	if c.reportURL != "" {
+		u, err := url.Parse(c.reportURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("-report-url %q must be an http or https URL", c.reportURL)
+		}
+	}
+	if name, _, ok := strings.Cut(c.reportAuthHeader, ":"); c.reportAuthHeader != "" && (!ok || strings.TrimSpace(name) == "") {
+		return fmt.Errorf("-report-auth-header must have the form Name: value")
+	}
+	if len(c.outputs) == 0 {
+		return fmt.Errorf("-output must name at least one destination")
+	}
+
+	if _, ok := serialChecksums[c.verifySerialChecksum]; c.verifySerialChecksum != "" && !ok {
+		return fmt.Errorf("-verify-serial-checksum %q must be luhn16", c.verifySerialChecksum)
+	}
+
+	switch c.legacySerialMode {
+	case "sum", "concat-decimal", "disabled":
+	default:
+		return fmt.Errorf("-legacy-serial-mode %q must be one of sum, concat-decimal, disabled", c.legacySerialMode)
+	}
+
+	if c.legacySerialBase != 10 && c.legacySerialBase != 16 {
+		return fmt.Errorf("-legacy-serial-base %d must be 10 or 16", c.legacySerialBase)
+	}
+
+	switch c.realSerialOrder {
+	case "cfg1cfg0", "cfg0cfg1":
+	default:
+		return fmt.Errorf("-real-serial-order %q must be cfg1cfg0 or cfg0cfg1", c.realSerialOrder)
+	}
+
+	switch c.serialHexCase {
+	case "lower", "upper":
+	default:
+		return fmt.Errorf("-serial-hex-case %q must be lower or upper", c.serialHexCase)
+	}
+
+	if c.serialFormat != "" {
+		if _, err := versioninfo.FormatSerial(c.serialFormat, 0, c.legacySerialMode != "disabled", 0); err != nil {
+			return fmt.Errorf("-serial-format: %w", err)
+		}
+	}
+
+	if c.serialDisplayFormat != "" {
+		if _, err := versioninfo.DisplaySerial(c.serialDisplayFormat, strings.Repeat("0", 16)); err != nil {
+			return fmt.Errorf("-serial-display-format: %w", err)
+		}
+	}
+
+	if c.redisOpRetries < 0 {
+		return fmt.Errorf("-redis-op-retries must not be negative")
+	}
+
+	switch c.timestampFormat {
+	case "rfc3339", "epoch":
+	default:
+		return fmt.Errorf("-timestamp-format %q must be rfc3339 or epoch", c.timestampFormat)
+	}
+
+	switch c.redisKeyMode {
+	case "hash", "keys":
+	default:
+		return fmt.Errorf("-redis-key-mode %q must be hash or keys", c.redisKeyMode)
+	}
+	if c.redisKeyPrefix == "" {
+		c.redisKeyPrefix = c.hashName
+	}
+	if c.namespace != "" {
+		c.hashName = c.namespace + ":" + c.hashName
+		c.redisKeyPrefix = c.namespace + ":" + c.redisKeyPrefix
+		if c.serialHash != "" {
+			c.serialHash = c.namespace + ":" + c.serialHash
+		}
+	}
+
+	if c.interval < 0 {
+		return fmt.Errorf("-interval must not be negative")
+	}
+	if c.redisPingInterval < 0 {
+		return fmt.Errorf("-redis-ping-interval must not be negative")
+	}
+	if c.breakerThreshold < 0 {
+		return fmt.Errorf("-redis-breaker-threshold must not be negative")
+	}
+	if c.breakerCooldown <= 0 {
+		return fmt.Errorf("-redis-breaker-cooldown must be positive")
+	}
+
+	if c.noSerial && c.onceCheck {
+		return fmt.Errorf("-no-serial cannot be combined with -once-check")
+	}
+	if c.compare && (c.daemon() || c.onceCheck) {
+		return fmt.Errorf("-compare cannot be combined with -interval, -watch or -once-check")
+	}
+	if c.selftest && (c.daemon() || c.onceCheck || c.compare) {
+		return fmt.Errorf("-selftest cannot be combined with -interval, -watch, -once-check or -compare")
+	}
+	if c.reset {
+		if c.daemon() || c.onceCheck || c.compare || c.selftest {
+			return fmt.Errorf("-reset cannot be combined with -interval, -watch, -once-check, -compare or -selftest")
+		}
+		if !c.yes {
+			return fmt.Errorf("-reset deletes the stored version information; add -yes to confirm")
+		}
+	}
+
+	return nil
+}
+
+// redisTarget describes the Redis endpoint for log and error messages.
+func (c *config) redisTarget() string {
+	if len(c.sentinelAddrs) > 0 {
+		return fmt.Sprintf("master %q via sentinels %s", c.masterName, strings.Join(c.sentinelAddrs, ","))
+	}
+	if len(c.clusterAddrs) > 0 {
+		return "cluster " + strings.Join(c.clusterAddrs, ",")
+	}
+	if c.redisURLOptions != nil {
+		return c.redisURLOptions.Addr
+	}
+	return c.redisAddr
+}
+
+// splitList splits a comma-separated flag value, dropping empty entries.
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// stringList is a repeatable flag collecting its values in order, one entry
+// per occurrence on the command line, so a value may contain commas. The
+// environment and config file give all entries at once through setAll.
+type stringList []string
+
+func (l *stringList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// setAll appends each of items as a separate entry.
+func (l *stringList) setAll(items []string) {
+	*l = append(*l, items...)
+}
+
+// parseStaticFields parses key=value entries into fields, rejecting
+// malformed and repeated keys.
+func parseStaticFields(entries []string) (*fieldSet, error) {
+	fields := newFieldSet()
+	for _, entry := range entries {
+		key, value, ok := strings.Cut(entry, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("%q: expected key=value", entry)
+		}
+		if _, dup := fields.get(key); dup {
+			return nil, fmt.Errorf("%q set twice", key)
+		}
+		fields.set(key, strings.TrimSpace(value))
+	}
+	return fields, nil
+}
+
+// daemon reports whether the service keeps running and refreshes the values
+// instead of exiting after one run.
+func (c *config) daemon() bool {
+	return c.interval > 0 || c.watch
+}
+
+// writesRedis reports whether the output mode involves Redis.
+func (c *config) writesRedis() bool {
+	return c.outputs["redis"]
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"strings"
+	"testing"
+)
+
+// parseTestFlags runs parseFlags over args on a fresh flag set, restoring
+// os.Args afterwards.
+func parseTestFlags(t *testing.T, args ...string) (*config, error) {
+	t.Helper()
+	oldArgs := os.Args
+	t.Cleanup(func() { os.Args = oldArgs })
+	os.Args = append([]string{"version-service"}, args...)
+	flag.CommandLine = flag.NewFlagSet("version-service", flag.ContinueOnError)
+	return parseFlags()
+}
+
+// validTestConfig parses args and validates the result, failing the test on
+// a parse error.
+func validTestConfig(t *testing.T, args ...string) (*config, error) {
+	t.Helper()
+	cfg, err := parseTestFlags(t, args...)
+	if err != nil {
+		t.Fatalf("parseFlags(%q): %v", args, err)
+	}
+	return cfg, cfg.validate()
+}
+
+func TestValidateMQTTCredentials(t *testing.T) {
+	tests := []struct {
+		args    []string
+		wantErr string
+	}{
+		{[]string{"-mqtt-broker", "localhost"}, ""},
+		{[]string{"-mqtt-broker", "localhost", "-mqtt-username", "scooter"}, ""},
+		{[]string{"-mqtt-broker", "localhost", "-mqtt-username", "scooter", "-mqtt-password", "secret"}, ""},
+		{[]string{"-mqtt-broker", "localhost", "-mqtt-password", "secret"}, "-mqtt-password requires -mqtt-username"},
+		{[]string{"-output", "mqtt"}, "-output mqtt requires -mqtt-broker"},
+	}
+	for _, tt := range tests {
+		_, err := validTestConfig(t, tt.args...)
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("%q: unexpected error %v", tt.args, err)
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("%q: got error %v, want %q", tt.args, err, tt.wantErr)
+		}
+	}
+}
+
+func TestEnvName(t *testing.T) {
+	tests := map[string]string{
+		"os-release-path": "VERSIONSERVICE_OS_RELEASE_PATH",
+		"hash":            "VERSIONSERVICE_HASH",
+		"redis":           "VERSIONSERVICE_REDIS_ADDR",
+	}
+	for name, want := range tests {
+		if got := envName(name); got != want {
+			t.Errorf("envName(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestParseFlagsFromEnv(t *testing.T) {
+	t.Setenv("VERSIONSERVICE_REDIS_ADDR", "10.0.0.1:6379")
+	t.Setenv("VERSIONSERVICE_HASH", "version:mdb")
+	t.Setenv("VERSIONSERVICE_OS_RELEASE_PATH", "/tmp/os-release")
+	t.Setenv("VERSIONSERVICE_STRICT", "true")
+	t.Setenv("VERSIONSERVICE_REDIS_DB", "3")
+
+	cfg, err := parseTestFlags(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.redisAddr != "10.0.0.1:6379" || cfg.hashName != "version:mdb" || cfg.osReleasePath != "/tmp/os-release" || !cfg.strict || cfg.redisDB != 3 {
+		t.Errorf("got redis %q, hash %q, os-release %q, strict %v, db %d", cfg.redisAddr, cfg.hashName, cfg.osReleasePath, cfg.strict, cfg.redisDB)
+	}
+	if !cfg.setFlags["hash"] {
+		t.Error("hash from the environment not marked as set")
+	}
+}
+
+func TestParseFlagsInvalidEnv(t *testing.T) {
+	t.Setenv("VERSIONSERVICE_REDIS_DB", "three")
+	_, err := parseTestFlags(t)
+	if err == nil || !strings.Contains(err.Error(), "VERSIONSERVICE_REDIS_DB") {
+		t.Fatalf("got %v, want an error naming VERSIONSERVICE_REDIS_DB", err)
+	}
+}
+
+// TestParseFlagsPrecedence checks command line > environment > config file >
+// default, one option at each level.
+func TestParseFlagsPrecedence(t *testing.T) {
+	path := t.TempDir() + "/version-service.toml"
+	content := `hash = "from-file"
+redis = "file:6379"
+os_release_path = "/file/os-release"
+mqtt_topic = "file/topic"
+`
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("VERSIONSERVICE_HASH", "from-env")
+	t.Setenv("VERSIONSERVICE_REDIS_ADDR", "env:6379")
+	t.Setenv("VERSIONSERVICE_OS_RELEASE_PATH", "/env/os-release")
+
+	cfg, err := parseTestFlags(t, "-config", path, "-hash", "from-flag")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checks := []struct{ option, got, want string }{
+		{"hash (flag, env and file)", cfg.hashName, "from-flag"},
+		{"redis (env and file)", cfg.redisAddr, "env:6379"},
+		{"os-release-path (env and file)", cfg.osReleasePath, "/env/os-release"},
+		{"mqtt-topic (file)", cfg.mqttTopic, "file/topic"},
+		{"timestamp-format (default)", cfg.timestampFormat, "rfc3339"},
+	}
+	for _, c := range checks {
+		if c.got != c.want {
+			t.Errorf("%s: got %q, want %q", c.option, c.got, c.want)
+		}
+	}
+}
+
+func TestStaticFields(t *testing.T) {
+	path := t.TempDir() + "/version-service.toml"
+	tests := []struct {
+		name string
+		args []string
+		env  string
+		file string
+		want map[string]string
+	}{
+		{
+			name: "command line keeps commas",
+			args: []string{"-set", "note=a,b", "-set", "batch=2024-07"},
+			want: map[string]string{"note": "a,b", "batch": "2024-07"},
+		},
+		{
+			name: "environment splits on commas",
+			env:  "batch=2024-07,site=ber",
+			want: map[string]string{"batch": "2024-07", "site": "ber"},
+		},
+		{
+			name: "config file array item keeps commas",
+			file: `set = ["note=a,b", "site=ber"]`,
+			want: map[string]string{"note": "a,b", "site": "ber"},
+		},
+		{
+			name: "config file string splits on commas",
+			file: `set = "batch=2024-07,site=ber"`,
+			want: map[string]string{"batch": "2024-07", "site": "ber"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := tt.args
+			if tt.env != "" {
+				t.Setenv("VERSIONSERVICE_SET", tt.env)
+			}
+			if tt.file != "" {
+				if err := os.WriteFile(path, []byte(tt.file+"\n"), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				args = append(args, "-config", path)
+			}
+			cfg, err := validTestConfig(t, args...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.extraFields.size() != len(tt.want) {
+				t.Errorf("got %d fields, want %d", cfg.extraFields.size(), len(tt.want))
+			}
+			for key, want := range tt.want {
+				if got, _ := cfg.extraFields.get(key); got != want {
+					t.Errorf("%s = %q, want %q", key, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateLegacySerialMode(t *testing.T) {
+	for _, mode := range []string{"sum", "concat-decimal", "disabled"} {
+		if _, err := validTestConfig(t, "-legacy-serial-mode", mode); err != nil {
+			t.Errorf("%s: %v", mode, err)
+		}
+	}
+	_, err := validTestConfig(t, "-legacy-serial-mode", "concat")
+	if err == nil || !strings.Contains(err.Error(), "sum, concat-decimal, disabled") {
+		t.Errorf("concat: got %v, want an error listing the modes", err)
+	}
+}
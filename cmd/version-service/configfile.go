@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// applyConfigFile sets every flag named in the config file at path that was
+// not given on the command line. The file uses a flat TOML subset: one
+// `key = value` per line, where keys are flag names (dashes or underscores),
+// values are quoted strings, numbers, booleans or arrays of strings (joined
+// with commas for list flags, one entry per item for -set), and `#` starts a
+// comment.
+func applyConfigFile(path string, setFlags map[string]bool) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open config file: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, raw, ok := strings.Cut(line, "=")
+		if !ok {
+			return fmt.Errorf("%s:%d: expected key = value: %s", path, lineNo, line)
+		}
+		name := strings.ReplaceAll(strings.TrimSpace(key), "_", "-")
+		if name == "config" || flag.Lookup(name) == nil {
+			return fmt.Errorf("%s:%d: unknown option %q", path, lineNo, strings.TrimSpace(key))
+		}
+
+		if list, ok := flag.Lookup(name).Value.(*stringList); ok {
+			items, err := parseConfigList(strings.TrimSpace(raw))
+			if err != nil {
+				return fmt.Errorf("%s:%d: %v: %s", path, lineNo, err, line)
+			}
+			if !setFlags[name] {
+				list.setAll(items)
+				setFlags[name] = true
+			}
+			continue
+		}
+
+		value, err := parseConfigValue(strings.TrimSpace(raw))
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v: %s", path, lineNo, err, line)
+		}
+
+		if setFlags[name] {
+			continue // command line wins
+		}
+		if err := flag.Set(name, value); err != nil {
+			return fmt.Errorf("%s:%d: invalid value for %s: %v", path, lineNo, name, err)
+		}
+		setFlags[name] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("error reading %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// parseConfigValue decodes a TOML scalar or string array into the string
+// form flag.Set expects.
+func parseConfigValue(raw string) (string, error) {
+	raw = stripConfigComment(raw)
+	switch {
+	case raw == "":
+		return "", fmt.Errorf("missing value")
+	case strings.HasPrefix(raw, "["):
+		items, err := parseConfigList(raw)
+		if err != nil {
+			return "", err
+		}
+		return strings.Join(items, ","), nil
+	case strings.HasPrefix(raw, `"`):
+		value, err := strconv.Unquote(raw)
+		if err != nil {
+			return "", fmt.Errorf("malformed string")
+		}
+		return value, nil
+	case strings.HasPrefix(raw, "'"):
+		if len(raw) < 2 || !strings.HasSuffix(raw, "'") {
+			return "", fmt.Errorf("malformed string")
+		}
+		return raw[1 : len(raw)-1], nil
+	default:
+		// Bare numbers and booleans
+		return raw, nil
+	}
+}
+
+// parseConfigList decodes the value of a repeatable flag: each item of a
+// string array is one entry, commas included, while a scalar is split on
+// commas like the environment form.
+func parseConfigList(raw string) ([]string, error) {
+	raw = stripConfigComment(raw)
+	if !strings.HasPrefix(raw, "[") {
+		value, err := parseConfigValue(raw)
+		if err != nil {
+			return nil, err
+		}
+		return splitList(value), nil
+	}
+	if !strings.HasSuffix(raw, "]") {
+		return nil, fmt.Errorf("unterminated array")
+	}
+
+	var items []string
+	for _, item := range splitConfigArray(raw[1 : len(raw)-1]) {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		value, err := parseConfigValue(item)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, value)
+	}
+	return items, nil
+}
+
+// splitConfigArray splits the inside of an array at the commas that are
+// outside quotes.
+func splitConfigArray(s string) []string {
+	var items []string
+	var quote rune
+	start := 0
+	for i, r := range s {
+		switch {
+		case quote != 0:
+			if r == quote && (quote == '\'' || s[i-1] != '\\') {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == ',':
+			items = append(items, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(items, s[start:])
+}
+
+// stripConfigComment removes a trailing # comment that is outside quotes.
+func stripConfigComment(raw string) string {
+	var quote rune
+	for i, r := range raw {
+		switch {
+		case quote != 0:
+			if r == quote && (quote == '\'' || i == 0 || raw[i-1] != '\\') {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == '#':
+			return strings.TrimSpace(raw[:i])
+		}
+	}
+	return raw
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"sort"
+	"strings"
+)
+
+// fieldSet is an ordered collection of string fields. Iteration, JSON
+// encoding and Redis writes follow insertion order, so logs and output are
+// reproducible between runs.
+type fieldSet struct {
+	keys   []string
+	values map[string]string
+}
+
+func newFieldSet() *fieldSet {
+	return &fieldSet{values: make(map[string]string)}
+}
+
+// set stores value under key. A key that is already present keeps its
+// original position.
+func (f *fieldSet) set(key, value string) {
+	if _, ok := f.values[key]; !ok {
+		f.keys = append(f.keys, key)
+	}
+	f.values[key] = value
+}
+
+// get returns the value stored under key.
+func (f *fieldSet) get(key string) (string, bool) {
+	value, ok := f.values[key]
+	return value, ok
+}
+
+// getFold returns the value of the first key equal to key under Unicode
+// case folding.
+func (f *fieldSet) getFold(key string) (string, bool) {
+	for _, k := range f.keys {
+		if strings.EqualFold(k, key) {
+			return f.values[k], true
+		}
+	}
+	return "", false
+}
+
+// size returns the number of fields.
+func (f *fieldSet) size() int {
+	return len(f.keys)
+}
+
+// each calls fn for every field in order.
+func (f *fieldSet) each(fn func(key, value string)) {
+	for _, key := range f.keys {
+		fn(key, f.values[key])
+	}
+}
+
+// hsetArgs returns the fields as alternating field and value arguments for
+// HSET.
+func (f *fieldSet) hsetArgs() []interface{} {
+	args := make([]interface{}, 0, 2*len(f.keys))
+	for _, key := range f.keys {
+		args = append(args, key, f.values[key])
+	}
+	return args
+}
+
+// MarshalJSON encodes the fields as a JSON object in insertion order.
+func (f *fieldSet) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, key := range f.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		v, err := json.Marshal(f.values[key])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// sortedJSON encodes the fields as a JSON object with the keys sorted, so the
+// result only depends on the contents.
+func (f *fieldSet) sortedJSON() (string, error) {
+	data, err := json.Marshal(f.values)
+	return string(data), err
+}
+
+// sortedFields logs a fieldSet as a group with the keys sorted, so debug logs
+// of two runs or two units can be diffed line by line. The group is only built
+// when the record is actually logged.
+type sortedFields struct{ *fieldSet }
+
+// LogValue implements slog.LogValuer.
+func (f sortedFields) LogValue() slog.Value {
+	keys := append([]string(nil), f.keys...)
+	sort.Strings(keys)
+	attrs := make([]slog.Attr, len(keys))
+	for i, key := range keys {
+		attrs[i] = slog.String(key, f.values[key])
+	}
+	return slog.GroupValue(attrs...)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"testing"
+)
+
+func TestSortedFieldsLogValue(t *testing.T) {
+	fields := newFieldSet()
+	fields.set("version_id", "1.2")
+	fields.set("build_id", "7")
+	fields.set("name", "LibreScoot")
+
+	attrs := sortedFields{fields}.LogValue().Group()
+	want := []string{"build_id=7", "name=LibreScoot", "version_id=1.2"}
+	if len(attrs) != len(want) {
+		t.Fatalf("got %v, want %v", attrs, want)
+	}
+	for i, attr := range attrs {
+		if attr.String() != want[i] {
+			t.Errorf("attr %d = %s, want %s", i, attr, want[i])
+		}
+	}
+
+	// Insertion order is left alone
+	if fields.keys[0] != "version_id" {
+		t.Errorf("LogValue reordered the field set: %v", fields.keys)
+	}
+
+	var buf bytes.Buffer
+	slog.New(slog.NewTextHandler(&buf, nil)).Info("Parsed", "fields", sortedFields{fields})
+	if !bytes.Contains(buf.Bytes(), []byte("fields.build_id=7 fields.name=LibreScoot fields.version_id=1.2")) {
+		t.Errorf("logged %q", buf.String())
+	}
+}
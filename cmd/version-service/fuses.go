@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/librescoot/version-service/pkg/versioninfo"
+)
+
+// fuseField is an extra range of the NVMEM device stored as a hash field,
+// configured with -fuse-map.
+type fuseField struct {
+	name   string
+	offset int
+	length int
+}
+
+// parseFuseMap parses -fuse-map entries of the form
+// name:offset=0x24,len=6, separated by semicolons.
+func parseFuseMap(s string) ([]fuseField, error) {
+	var fuses []fuseField
+	seen := make(map[string]bool)
+	for _, entry := range strings.Split(s, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		name, spec, ok := strings.Cut(entry, ":")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !ok || name == "" {
+			return nil, fmt.Errorf("fuse %q: expected name:offset=N,len=N", entry)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("fuse %q defined twice", name)
+		}
+		seen[name] = true
+
+		fuse := fuseField{name: name, offset: -1}
+		for _, param := range strings.Split(spec, ",") {
+			key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			n, err := strconv.ParseInt(value, 0, 32)
+			if err != nil {
+				return nil, fmt.Errorf("fuse %q: invalid %s %q", name, key, value)
+			}
+			switch key {
+			case "offset":
+				fuse.offset = int(n)
+			case "len":
+				fuse.length = int(n)
+			default:
+				return nil, fmt.Errorf("fuse %q: unknown parameter %q", name, key)
+			}
+		}
+		if fuse.offset < 0 {
+			return nil, fmt.Errorf("fuse %q: offset must be given and not negative", name)
+		}
+		if fuse.length < 1 || fuse.length > 64 {
+			return nil, fmt.Errorf("fuse %q: len must be between 1 and 64", name)
+		}
+		fuses = append(fuses, fuse)
+	}
+	return fuses, nil
+}
+
+// readFuseField reads fuse from the NVMEM device and returns its bytes as
+// hex in device order.
+func readFuseField(nvmemDevicePath string, fuse fuseField, timeout time.Duration) (string, error) {
+	data, err := versioninfo.ReadNVMEMBytes(nvmemDevicePath, fuse.offset, fuse.length, timeout)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(data), nil
+}
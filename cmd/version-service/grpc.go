@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	grpcstatus "google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// resultStore keeps the most recent collectResult for the gRPC server.
+type resultStore struct {
+	mu  sync.Mutex
+	res *collectResult
+}
+
+// latest is the result of the most recent collectFields call.
+var latest resultStore
+
+func (s *resultStore) store(res *collectResult) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.res = res
+}
+
+func (s *resultStore) load() *collectResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.res
+}
+
+// versionServer is the librescoot.version.v1.VersionService gRPC service.
+// It uses the well-known protobuf types so no generated code is needed:
+//
+//	rpc GetVersionInfo(google.protobuf.Empty) returns (google.protobuf.Struct)
+//
+// The Struct has the keys version (string), os_release and serial (both
+// objects of strings).
+type versionServer interface {
+	GetVersionInfo(context.Context, *emptypb.Empty) (*structpb.Struct, error)
+}
+
+var versionServiceDesc = grpc.ServiceDesc{
+	ServiceName: "librescoot.version.v1.VersionService",
+	HandlerType: (*versionServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "GetVersionInfo", Handler: getVersionInfoHandler},
+	},
+	Metadata: "version.proto",
+}
+
+func getVersionInfoHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(versionServer).GetVersionInfo(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/librescoot.version.v1.VersionService/GetVersionInfo",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(versionServer).GetVersionInfo(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// versionInfoServer answers GetVersionInfo from the latest collected result.
+type versionInfoServer struct{}
+
+// GetVersionInfo implements versionServer.
+func (versionInfoServer) GetVersionInfo(context.Context, *emptypb.Empty) (*structpb.Struct, error) {
+	res := latest.load()
+	if res == nil {
+		return nil, grpcstatus.Error(codes.Unavailable, "version information not collected yet")
+	}
+
+	info, err := structpb.NewStruct(map[string]interface{}{
+		"version":    version,
+		"os_release": fieldSetMap(res.osRelease),
+		"serial":     fieldSetMap(res.serial),
+	})
+	if err != nil {
+		return nil, grpcstatus.Error(codes.Internal, err.Error())
+	}
+	return info, nil
+}
+
+// fieldSetMap converts f for structpb.NewStruct.
+func fieldSetMap(f *fieldSet) map[string]interface{} {
+	m := make(map[string]interface{}, f.size())
+	f.each(func(key, value string) {
+		m[key] = value
+	})
+	return m
+}
+
+// startGRPCServer serves the version service on addr in the background and
+// stops it when ctx is cancelled.
+func startGRPCServer(ctx context.Context, addr string) error {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	srv := grpc.NewServer()
+	srv.RegisterService(&versionServiceDesc, versionInfoServer{})
+
+	go func() {
+		slog.Info("Serving gRPC", "addr", addr)
+		if err := srv.Serve(lis); err != nil {
+			slog.Error("gRPC server failed", "addr", addr, "error", err)
+		}
+	}()
+
+	go func() {
+		<-ctx.Done()
+		srv.GracefulStop()
+	}()
+	return nil
+}
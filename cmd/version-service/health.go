@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+)
+
+// Steps tracked for the readiness check.
+const (
+	stepOSRelease   = "os_release"
+	stepIdentifiers = "identifiers"
+	stepRedisWrite  = "redis_write"
+	stepRedisPing   = "redis_ping"
+)
+
+// runStatus records the outcome of each step of the most recent run.
+type runStatus struct {
+	mu    sync.Mutex
+	steps map[string]error
+}
+
+var status = runStatus{steps: make(map[string]error)}
+
+// record stores the result of step; a nil err marks it successful.
+func (s *runStatus) record(step string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.steps[step] = err
+}
+
+// readiness reports whether every recorded step succeeded, along with the
+// error message of each failed step.
+func (s *runStatus) readiness() (bool, map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	failed := make(map[string]string)
+	for step, err := range s.steps {
+		if err != nil {
+			failed[step] = err.Error()
+		}
+	}
+	return len(s.steps) > 0 && len(failed) == 0, failed
+}
+
+type readyResponse struct {
+	Ready  bool              `json:"ready"`
+	Failed map[string]string `json:"failed,omitempty"`
+}
+
+// startHealthServer serves /healthz and /readyz on addr until ctx is cancelled.
+func startHealthServer(ctx context.Context, addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		ready, failed := status.readiness()
+		w.Header().Set("Content-Type", "application/json")
+		if !ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(readyResponse{Ready: ready, Failed: failed})
+	})
+	serveHTTP(ctx, "health", addr, mux)
+}
@@ -0,0 +1,43 @@
+package main
+
+import "github.com/librescoot/version-service/pkg/versioninfo"
+
+// newIdentifierReader returns the IdentifierReader configured by cfg.
+func newIdentifierReader(cfg *config) versioninfo.IdentifierReader {
+	var reader versioninfo.IdentifierReader = &versioninfo.OCOTPReader{
+		Layout:       cfg.layout,
+		AllowZero:    cfg.allowZeroSerial,
+		WaitForNVMEM: cfg.waitForNVMEM,
+	}
+	if cfg.identifierCache != "" {
+		reader = &cachingReader{
+			path:    cfg.identifierCache,
+			refresh: cfg.identifierCacheRefresh,
+			next:    reader,
+		}
+	}
+	if cfg.watch {
+		reader = &memoReader{next: reader}
+	}
+	return reader
+}
+
+// memoReader reads the identifiers from next until a read succeeds and then
+// keeps returning that result, since the fused values never change. It is
+// used by -watch, where refreshes are about os-release only.
+type memoReader struct {
+	next versioninfo.IdentifierReader
+	ids  *versioninfo.Identifiers
+}
+
+// ReadIdentifiers implements versioninfo.IdentifierReader.
+func (r *memoReader) ReadIdentifiers() (versioninfo.Identifiers, error) {
+	if r.ids != nil {
+		return *r.ids, nil
+	}
+	ids, err := r.next.ReadIdentifiers()
+	if err == nil {
+		r.ids = &ids
+	}
+	return ids, err
+}
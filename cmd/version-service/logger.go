@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+)
+
+// setupLogging installs the default slog logger for the given -log-format
+// and -log-level. Text output goes through the standard log package so the
+// timestamp handling for journald is preserved; JSON output emits one object
+// per line with time, level, msg and any contextual fields.
+func setupLogging(format, level string) error {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("-log-level %q must be one of debug, info, warn, error", level)
+	}
+
+	switch format {
+	case "text":
+		if os.Getenv("JOURNAL_STREAM") != "" {
+			log.SetFlags(0)
+		} else {
+			log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds)
+		}
+		slog.SetLogLoggerLevel(lvl)
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: lvl})))
+	default:
+		return fmt.Errorf("-log-format %q must be text or json", format)
+	}
+	return nil
+}
+
+// fatal logs msg at error level and exits with status 1.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
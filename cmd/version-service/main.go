@@ -1,154 +1,491 @@
 package main
 
 import (
-	"bufio"
 	"context"
-	"flag"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
+	"os/signal"
+	"runtime"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
+	"github.com/librescoot/version-service/pkg/versioninfo"
 	"github.com/redis/go-redis/v9"
 )
 
 var version = "dev"
 
-// getIdentifierHexStrings attempts to read raw hex strings for CFG0 and CFG1.
-// It prioritizes NVMEM, then falls back to OTP sysfs files.
-// Returns the hex strings (which may be empty if a part is unreadable) and an error if any part could not be read from any source.
-func getIdentifierHexStrings() (cfg0Hex string, cfg1Hex string, err error) {
-	nvmemDevicePath := "/sys/bus/nvmem/devices/imx-ocotp0/nvmem"
-	otpCfg0Path := "/sys/fsl_otp/HW_OCOTP_CFG0"
-	otpCfg1Path := "/sys/fsl_otp/HW_OCOTP_CFG1"
+// clock returns the time stored in last_updated; replaceable for tests.
+var clock = time.Now
 
-	nvmemPresent := false
-	if _, statErr := os.Stat(nvmemDevicePath); statErr == nil {
-		nvmemPresent = true
+// Exit codes. With -strict, identifier and serial problems that are
+// otherwise only logged also terminate the process with a distinct code.
+const (
+	exitFailure        = 1 // configuration or Redis failure, or os-release with -strict
+	exitIdentifierRead = 2 // a device identifier part could not be read
+	exitSerialNotSaved = 3 // the serial numbers could not be computed or stored
+	exitCompareDiff    = 4 // -compare found the stored hash out of date
+)
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "version" {
+		printVersion()
+		return
+	}
+
+	cfg, err := parseFlags()
+	if err != nil {
+		fatal("Invalid configuration", "error", err)
 	}
 
-	var errMessages []string
+	if cfg.showVersion {
+		printVersion()
+		return
+	}
 
-	// --- Read CFG0 (Unique ID Part L) ---
-	var cfg0ErrDetails []string
-	if nvmemPresent {
-		val, nvmemErr := readHexValueFromNvmem(4) // Offset 4 for CFG0
-		if nvmemErr == nil {
-			cfg0Hex = val
-		} else {
-			cfg0ErrDetails = append(cfg0ErrDetails, fmt.Sprintf("NVMEM(offset 4): %s", nvmemErr.Error()))
+	if cfg.printConfig {
+		if err := printConfig(os.Stdout, cfg.printConfigFormat); err != nil {
+			fatal("Failed to print configuration", "error", err)
 		}
-	} else {
-		cfg0ErrDetails = append(cfg0ErrDetails, "NVMEM: not found")
+		return
 	}
 
-	if cfg0Hex == "" {
-		data, otpErr := os.ReadFile(otpCfg0Path)
-		if otpErr == nil {
-			content := strings.TrimSpace(string(data))
-			cfg0Hex = strings.TrimPrefix(strings.ToLower(content), "0x")
-			cfg0ErrDetails = []string{}
-		} else {
-			cfg0ErrDetails = append(cfg0ErrDetails, fmt.Sprintf("OTP(%s): %s", otpCfg0Path, otpErr.Error()))
+	if err := setupLogging(cfg.logFormat, cfg.logLevel); err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
+
+	slog.Info("librescoot-version starting", "version", version)
+
+	if err := cfg.validate(); err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
+
+	if cfg.onceCheck {
+		os.Exit(runOnceCheck(cfg, newIdentifierReader(cfg)))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigCh
+		slog.Info("Received signal, shutting down", "signal", sig.String())
+		cancel()
+	}()
+
+	if cfg.metricsAddr != "" {
+		startMetricsServer(ctx, cfg.metricsAddr)
+	}
+
+	if cfg.healthAddr != "" {
+		startHealthServer(ctx, cfg.healthAddr)
+	}
+
+	if cfg.grpcAddr != "" {
+		if err := startGRPCServer(ctx, cfg.grpcAddr); err != nil {
+			fatal("Failed to start gRPC server", "addr", cfg.grpcAddr, "error", err)
 		}
 	}
-	if cfg0Hex == "" && len(cfg0ErrDetails) > 0 {
-		errMessages = append(errMessages, fmt.Sprintf("CFG0_read_failed: {%s}", strings.Join(cfg0ErrDetails, ", ")))
+
+	if cfg.selftest {
+		os.Exit(runSelftest(ctx, cfg))
+	}
+
+	if cfg.reset {
+		os.Exit(runReset(ctx, cfg))
 	}
 
-	// --- Read CFG1 (Unique ID Part H) ---
-	var cfg1ErrDetails []string
-	if nvmemPresent {
-		val, nvmemErr := readHexValueFromNvmem(8) // Offset 8 for CFG1
-		if nvmemErr == nil {
-			cfg1Hex = val
-		} else {
-			cfg1ErrDetails = append(cfg1ErrDetails, fmt.Sprintf("NVMEM(offset 8): %s", nvmemErr.Error()))
+	if cfg.compare {
+		os.Exit(runCompare(ctx, cfg, newIdentifierReader(cfg)))
+	}
+
+	if cfg.daemon() {
+		runDaemon(ctx, cfg, newIdentifierReader(cfg))
+		return
+	}
+
+	start := time.Now()
+	reader := newIdentifierReader(cfg)
+	res, err := collectFields(cfg, reader)
+	if err != nil {
+		fatal("Failed to read OS release information", "error", err)
+	}
+
+	var conns []redisConn
+	if cfg.writesRedis() {
+		conns, err = connectRedisTargets(ctx, cfg)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			fatal("Failed to connect to Redis", "redis_addr", cfg.redisTarget(), "error", err)
 		}
-	} else {
-		cfg1ErrDetails = append(cfg1ErrDetails, "NVMEM: not found")
+		defer closeRedisTargets(conns)
 	}
 
-	if cfg1Hex == "" {
-		data, otpErr := os.ReadFile(otpCfg1Path)
-		if otpErr == nil {
-			content := strings.TrimSpace(string(data))
-			cfg1Hex = strings.TrimPrefix(strings.ToLower(content), "0x")
-			cfg1ErrDetails = []string{}
+	if err := emitFields(ctx, cfg, conns, res); err != nil {
+		// An interrupted write is a requested shutdown, not a failure; return
+		// so the deferred Close runs
+		if ctx.Err() != nil {
+			return
+		}
+		// The other fields were written; -strict singles out a missing serial
+		var fieldErr *fieldWriteError
+		if errors.As(err, &fieldErr) {
+			slog.Error("Some fields could not be stored", "hash", cfg.hashName, "failed", len(fieldErr.failed), "total", fieldErr.total, "fields", strings.Join(fieldErr.failed, ","))
+			code := exitFailure
+			if cfg.strict && fieldErr.serial {
+				code = exitSerialNotSaved
+			}
+			closeRedisTargets(conns)
+			os.Exit(code)
+		}
+		fatal("Failed to store version information", "hash", cfg.hashName, "error", err)
+	}
+	logRunSummary(res, start)
+
+	if code := res.strictExitCode(); cfg.strict && code != 0 {
+		slog.Error("Strict mode: device identity incomplete", "exit_code", code)
+		closeRedisTargets(conns)
+		os.Exit(code)
+	}
+}
+
+// printVersion prints the build version along with the Go runtime version and
+// the platform the binary was built for.
+func printVersion() {
+	fmt.Printf("version-service %s (%s %s/%s)\n", version, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+}
+
+// runDaemon connects once and then refreshes the stored values every
+// cfg.interval and, with -watch, whenever os-release changes, until ctx is
+// cancelled.
+func runDaemon(ctx context.Context, cfg *config, reader versioninfo.IdentifierReader) {
+	var conns []redisConn
+	if cfg.writesRedis() {
+		var err error
+		conns, err = connectRedisTargets(ctx, cfg)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			fatal("Failed to connect to Redis", "redis_addr", cfg.redisTarget(), "error", err)
+		}
+		defer closeRedisTargets(conns)
+	}
+
+	interval := cfg.interval
+	var changed <-chan struct{}
+	if cfg.watch {
+		var err error
+		changed, err = watchOSRelease(ctx, cfg.osReleasePath)
+		if err != nil {
+			if interval == 0 {
+				interval = watchFallbackInterval
+			}
+			slog.Warn("Cannot watch os-release, polling instead", "path", cfg.osReleasePath, "interval", interval.String(), "error", err)
 		} else {
-			cfg1ErrDetails = append(cfg1ErrDetails, fmt.Sprintf("OTP(%s): %s", otpCfg1Path, otpErr.Error()))
+			slog.Info("Watching os-release for changes", "path", cfg.osReleasePath)
 		}
 	}
-	if cfg1Hex == "" && len(cfg1ErrDetails) > 0 {
-		errMessages = append(errMessages, fmt.Sprintf("CFG1_read_failed: {%s}", strings.Join(cfg1ErrDetails, ", ")))
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+		slog.Info("Refreshing periodically", "interval", interval.String())
 	}
 
-	if len(errMessages) > 0 {
-		err = fmt.Errorf(strings.Join(errMessages, "; "))
+	// Pings run in this loop rather than their own goroutine since they
+	// may replace clients in conns
+	var ping <-chan time.Time
+	if cfg.redisPingInterval > 0 && cfg.writesRedis() {
+		pingTicker := time.NewTicker(cfg.redisPingInterval)
+		defer pingTicker.Stop()
+		ping = pingTicker.C
+	}
+
+	refresh := func() {
+		start := time.Now()
+		res, err := collectFields(cfg, reader)
+		if err != nil {
+			slog.Error("Failed to read OS release information", "error", err)
+		} else if err := emitFields(ctx, cfg, conns, res); err != nil {
+			// The breaker already logged opening the circuit
+			if errors.Is(err, errCircuitOpen) {
+				slog.Debug("Skipped storing version information", "hash", cfg.hashName, "error", err)
+			} else if ctx.Err() == nil {
+				slog.Error("Failed to store version information", "hash", cfg.hashName, "error", err)
+			}
+		} else {
+			logRunSummary(res, start)
+			if code := res.strictExitCode(); cfg.strict && code != 0 {
+				slog.Error("Strict mode: device identity incomplete", "exit_code", code)
+			}
+		}
+	}
+
+	refresh()
+	for {
+		select {
+		case <-tick:
+			refresh()
+		case <-changed:
+			slog.Info("os-release changed, refreshing")
+			refresh()
+		case <-ping:
+			pingRedisTargets(ctx, cfg, conns)
+		case <-ctx.Done():
+			return
+		}
 	}
-	return
 }
 
-func main() {
-	redisAddr := flag.String("redis", "192.168.7.1:6379", "Redis server address")
-	hashName := flag.String("hash", "os-release", "Redis hash name to store the values")
-	showVersion := flag.Bool("version", false, "Print version and exit")
-	flag.Parse()
+// collectResult is the outcome of collectFields.
+type collectResult struct {
+	// osRelease is the os-release data as read.
+	osRelease *fieldSet
+
+	// osReleaseFields is the number of os-release entries in fields, and
+	// identifierSource where the identifiers came from.
+	osReleaseFields  int
+	identifierSource string
+
+	// fields holds everything to store, with -field-prefix applied; serial
+	// holds just the unprefixed identity fields and serialFields the same
+	// fields under the names they are stored as.
+	fields       *fieldSet
+	serial       *fieldSet
+	serialFields *fieldSet
+
+	// identifierErr is set when a device identifier part could not be read,
+	// serialErr when the serial numbers could not be computed.
+	identifierErr error
+	serialErr     error
+}
 
-	if *showVersion {
-		fmt.Printf("version-service %s\n", version)
-		return
+// strictExitCode returns the exit code -strict mode uses for r, or 0 if the
+// device identity was stored completely.
+func (r *collectResult) strictExitCode() int {
+	switch {
+	case r.identifierErr != nil:
+		return exitIdentifierRead
+	case r.serialErr != nil:
+		return exitSerialNotSaved
+	default:
+		return 0
 	}
+}
 
-	if os.Getenv("JOURNAL_STREAM") != "" {
-		log.SetFlags(0)
+// collectFields reads os-release and the device identifiers and returns the
+// hash fields to store. Identifier problems are logged and recorded in the
+// result but not returned as errors. An unreadable os-release is an error
+// only with -strict; otherwise it is logged and the identity is still
+// collected, e.g. on a recovery image without os-release.
+func collectFields(cfg *config, reader versioninfo.IdentifierReader) (*collectResult, error) {
+	osReleaseData, usedPath, err := loadOSRelease(cfg.osReleasePath, cfg.osReleaseOptions())
+	status.record(stepOSRelease, err)
+	if err != nil {
+		if cfg.strict {
+			return nil, err
+		}
+		slog.Warn("Failed to read OS release information, storing the device identity only", "error", err)
+		osReleaseData = newFieldSet()
 	} else {
-		log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds)
+		slog.Debug("Read OS release information", "path", usedPath)
+		slog.Debug("Parsed OS release fields", "fields", sortedFields{osReleaseData})
 	}
+	osReleaseErr := err
 
-	log.Printf("librescoot-version %s starting", version)
-
-	osReleaseData, err := readOSRelease()
-	if err != nil {
-		log.Fatalf("Failed to read OS release information: %v", err)
+	// The options name keys in lowercase whatever -preserve-key-case says
+	selected := func(key string) bool {
+		return len(cfg.fieldAllowlist) == 0 || cfg.fieldAllowlist[strings.ToLower(key)]
 	}
+	// Fields stored under their own name, which a rename must not overwrite
+	kept := make(map[string]bool)
+	osReleaseData.each(func(key, _ string) {
+		if _, renamed := cfg.renames[strings.ToLower(key)]; !renamed && selected(key) {
+			kept[key] = true
+		}
+	})
 
-	rdb := redis.NewClient(&redis.Options{
-		Addr:         *redisAddr,
-		DialTimeout:  5 * time.Second,
-		ReadTimeout:  3 * time.Second,
-		WriteTimeout: 3 * time.Second,
+	osFields := newFieldSet()
+	osReleaseData.each(func(key, value string) {
+		lowerKey := strings.ToLower(key)
+		if !selected(key) {
+			return
+		}
+		name := key
+		if newName, ok := cfg.renames[lowerKey]; ok {
+			if kept[newName] {
+				slog.Warn("Not renaming os-release field onto an existing field", "key", key, "rename", newName)
+			} else {
+				name = newName
+			}
+		}
+		osFields.set(cfg.fieldPrefix+name, applyTransforms(cfg.transforms[lowerKey], value))
 	})
-	defer rdb.Close()
+	osReleaseFields := osFields.size()
 
-	ctx := context.Background()
+	fields := newFieldSet()
+	if cfg.jsonBlobField == "" || cfg.jsonBlobMode == "both" {
+		osFields.each(fields.set)
+	}
+	if cfg.jsonBlobField != "" {
+		blob, err := osFields.sortedJSON()
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode %s: %w", cfg.jsonBlobField, err)
+		}
+		fields.set(cfg.jsonBlobField, blob)
+	}
+	// Flag an OTA that updated the image but not this service
+	if imageVersion, ok := osReleaseData.getFold(cfg.versionCompareKey); ok && cfg.versionCompareKey != "" {
+		mismatch := strings.TrimPrefix(imageVersion, "v") != strings.TrimPrefix(version, "v")
+		fields.set("version_mismatch", strconv.FormatBool(mismatch))
+		if mismatch {
+			slog.Debug("Service version differs from image", "version", version, cfg.versionCompareKey, imageVersion)
+		}
+	}
 
-	_, err = rdb.Ping(ctx).Result()
-	if err != nil {
-		log.Fatalf("Failed to connect to Redis at %s: %v", *redisAddr, err)
+	if osReleaseErr == nil {
+		fields.set("osrelease_digest", osReleaseDigest(osReleaseData))
+	}
+
+	for _, fuse := range cfg.fuses {
+		value, err := readFuseField(cfg.layout.NVMEMPath, fuse, cfg.layout.ReadTimeout)
+		if err != nil {
+			slog.Warn("Failed to read fuse field", "field", fuse.name, "error", err)
+			continue
+		}
+		fields.set(fuse.name, value)
+	}
+
+	if cfg.includeUname {
+		if kernel, err := readKernelRelease(cfg.kernelReleasePath); err == nil {
+			fields.set("kernel_version", kernel)
+		} else {
+			slog.Warn("Failed to read kernel version", "path", cfg.kernelReleasePath, "error", err)
+		}
+	}
+	if cfg.includeUptime {
+		if uptime, err := readUptime(cfg.uptimePath); err == nil {
+			fields.set("uptime_seconds", uptime)
+		} else {
+			slog.Warn("Failed to read uptime", "path", cfg.uptimePath, "error", err)
+		}
 	}
 
-	fields := make(map[string]interface{}, len(osReleaseData)+2)
-	for key, value := range osReleaseData {
-		fields[key] = value
+	cfg.extraFields.each(fields.set)
+
+	res := &collectResult{osRelease: osReleaseData, fields: fields, osReleaseFields: osReleaseFields}
+	if cfg.noSerial {
+		res.serial = newFieldSet()
+		res.identifierSource = "disabled"
+	} else {
+		collectIdentity(cfg, reader, res)
 	}
 
+	res.serialFields = newFieldSet()
+	res.serial.each(func(key, value string) {
+		if cfg.prefixSerialFields {
+			key = cfg.fieldPrefix + key
+		}
+		res.serialFields.set(key, value)
+		fields.set(key, value)
+	})
+
+	fields.set("last_updated", formatTimestamp(clock(), cfg.timestampFormat))
+
+	latest.store(res)
+	return res, nil
+}
+
+// collectIdentity reads the device identifier parts from reader and stores
+// the serial fields derived from them in res.serial.
+func collectIdentity(cfg *config, reader versioninfo.IdentifierReader, res *collectResult) {
+	res.serial = newFieldSet()
+	fields := res.serial
+
 	// Read device identifier parts (CFG0, CFG1)
-	cfg0Hex, cfg1Hex, partsErr := getIdentifierHexStrings()
+	ids, partsErr := reader.ReadIdentifiers()
+	cfg0Hex, cfg1Hex := ids.CFG0, ids.CFG1
+	status.record(stepIdentifiers, partsErr)
+	res.identifierSource = ids.Source()
+
+	// All-zero fuses were read fine but would give every such board serial 0
+	unprovisioned := errors.Is(partsErr, versioninfo.ErrNotProvisioned)
+	if unprovisioned {
+		slog.Warn("Device identifiers are all zero, board appears unprovisioned", "serial_cfg0", cfg0Hex, "serial_cfg1", cfg1Hex)
+		partsErr = nil
+	}
+	res.identifierErr = partsErr
 
 	if partsErr != nil {
-		log.Printf("Warning: Failed to read one or more device identifier parts: %v", partsErr)
+		metrics.identifierReadErrors.Add(1)
+		slog.Warn("Failed to read one or more device identifier parts", "error", partsErr)
 	}
 
-	if cfg0Hex != "" && cfg1Hex != "" {
-		cfg0Val, errParse0 := parseHexFromString(cfg0Hex)
-		cfg1Val, errParse1 := parseHexFromString(cfg1Hex)
+	if ids.DTSerial != "" {
+		fields.set("serial_devicetree", ids.DTSerial)
+	}
+	if cfg0Hex != "" {
+		fields.set("serial_cfg0", serialHexCase(cfg.serialHexCase, cfg0Hex))
+		if cfg.storeFieldSource {
+			fields.set("serial_cfg0_source", ids.CFG0Source)
+		}
+	}
+	if cfg1Hex != "" {
+		fields.set("serial_cfg1", serialHexCase(cfg.serialHexCase, cfg1Hex))
+		if cfg.storeFieldSource {
+			fields.set("serial_cfg1_source", ids.CFG1Source)
+		}
+	}
+
+	if unprovisioned && cfg.strict {
+		slog.Error("Strict mode: not storing serial numbers of an unprovisioned board")
+		res.serialErr = versioninfo.ErrNotProvisioned
+	} else if cfg0Hex != "" && cfg1Hex != "" {
+		cfg0Val, errParse0 := versioninfo.ParseFuseWord(cfg0Hex)
+		cfg1Val, errParse1 := versioninfo.ParseFuseWord(cfg1Hex)
 
 		if errParse0 == nil && errParse1 == nil {
-			fields["serial_number"] = fmt.Sprintf("%d", cfg0Val+cfg1Val)
-			fields["serial_number_real"] = cfg1Hex + cfg0Hex
+			legacyVal, hasLegacy := versioninfo.LegacySerial(cfg.legacySerialMode, cfg0Val, cfg1Val)
+			if hasLegacy {
+				// Lowercase in base 16 whatever -serial-hex-case says, as
+				// serial_number predates that option
+				fields.set("serial_number", strconv.FormatUint(legacyVal, cfg.legacySerialBase))
+			}
+			serialReal := versioninfo.RealSerial(cfg.realSerialOrder, cfg0Hex, cfg1Hex)
+			fields.set("serial_number_real", serialHexCase(cfg.serialHexCase, serialReal))
+			if cfg.includeSerialRaw {
+				fields.set("serial_number_raw", versioninfo.RawSerial(ids.CFG0Raw, ids.CFG1Raw, cfg0Val, cfg1Val))
+			}
+			if cfg.serialDisplayFormat != "" {
+				if display, err := versioninfo.DisplaySerial(cfg.serialDisplayFormat, serialHexCase(cfg.serialHexCase, serialReal)); err == nil {
+					fields.set("serial_number_display", display)
+				} else {
+					slog.Warn("Failed to format serial number for display", "error", err)
+				}
+			}
+			if cfg.serialFormat != "" {
+				realVal, _ := strconv.ParseUint(serialReal, 16, 64)
+				if formatted, err := versioninfo.FormatSerial(cfg.serialFormat, legacyVal, hasLegacy, realVal); err == nil {
+					fields.set("serial_number_formatted", formatted)
+				} else {
+					slog.Warn("Failed to format serial number", "error", err)
+				}
+			}
+			if cfg.verifySerialChecksum != "" && !serialChecksums[cfg.verifySerialChecksum](serialReal) {
+				slog.Warn("serial_number_real fails checksum, identifier read may be corrupt", "serial_number_real", serialReal, "checksum", cfg.verifySerialChecksum)
+			}
 		} else {
 			var parseErrParts []string
 			if errParse0 != nil {
@@ -157,87 +494,325 @@ func main() {
 			if errParse1 != nil {
 				parseErrParts = append(parseErrParts, fmt.Sprintf("CFG1 ('%s') parse error: %v", cfg1Hex, errParse1))
 			}
-			log.Printf("Warning: Failed to calculate serial numbers: %s", strings.Join(parseErrParts, "; "))
+			slog.Warn("Failed to calculate serial numbers", "error", strings.Join(parseErrParts, "; "))
+			res.serialErr = fmt.Errorf("%s", strings.Join(parseErrParts, "; "))
+			status.record(stepIdentifiers, res.serialErr)
 		}
-	} else if partsErr != nil {
-		log.Printf("Warning: Could not compute serial numbers, identifier parts missing")
+	} else {
+		if partsErr != nil {
+			slog.Warn("Could not compute serial numbers, identifier parts missing")
+		}
+		res.serialErr = errors.New("identifier parts missing")
 	}
+}
 
-	// Write all fields in a single Redis call
-	if err := rdb.HSet(ctx, *hashName, fields).Err(); err != nil {
-		log.Fatalf("Failed to write to Redis hash '%s': %v", *hashName, err)
+// formatTimestamp renders t for last_updated as RFC 3339 in UTC or as Unix
+// seconds.
+func formatTimestamp(t time.Time, format string) string {
+	if format == "epoch" {
+		return strconv.FormatInt(t.Unix(), 10)
 	}
+	return t.UTC().Format(time.RFC3339)
+}
 
-	log.Printf("Stored %d fields in Redis hash '%s'", len(fields), *hashName)
+// logRunSummary logs the outcome of one successful run in a single line.
+func logRunSummary(res *collectResult, start time.Time) {
+	slog.Info("Version information stored",
+		"os_release_fields", res.osReleaseFields,
+		"serial_computed", res.serialErr == nil && res.serial.size() > 0,
+		"identifier_source", res.identifierSource,
+		"duration", time.Since(start).Round(time.Millisecond).String())
 }
 
-// readHexValueFromNvmem reads a 4-byte hex value from NVMEM at a given offset.
-func readHexValueFromNvmem(offset int) (string, error) {
-	nvmemDevicePath := "/sys/bus/nvmem/devices/imx-ocotp0/nvmem"
+// runOnceCheck prints the device identity as key=value lines without
+// reading os-release or connecting to Redis, and returns the exit code.
+func runOnceCheck(cfg *config, reader versioninfo.IdentifierReader) int {
+	res := &collectResult{}
+	collectIdentity(cfg, reader, res)
 
-	file, err := os.Open(nvmemDevicePath)
-	if err != nil {
-		return "", fmt.Errorf("failed to open NVMEM device %s: %v", nvmemDevicePath, err)
+	res.serial.each(func(key, value string) {
+		fmt.Printf("%s=%s\n", key, value)
+	})
+
+	return res.strictExitCode()
+}
+
+// emitFields sends the fields in res to the configured outputs. conns is
+// empty when the output mode does not involve Redis.
+func emitFields(ctx context.Context, cfg *config, conns []redisConn, res *collectResult) error {
+	fields := res.fields
+	if cfg.outputs["json"] {
+		// Keys are the Redis hash field names, so all outputs share one schema
+		out, err := json.MarshalIndent(fields, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to encode fields as JSON: %w", err)
+		}
+		fmt.Println(string(out))
 	}
-	defer file.Close()
 
-	_, err = file.Seek(int64(offset), 0)
-	if err != nil {
-		return "", fmt.Errorf("failed to seek in NVMEM device %s to offset %d: %v", nvmemDevicePath, offset, err)
+	if cfg.outputs["yaml"] {
+		if err := writeYAML(os.Stdout, res); err != nil {
+			return fmt.Errorf("failed to write YAML: %w", err)
+		}
 	}
 
-	buffer := make([]byte, 4)
-	n, err := file.Read(buffer)
-	if err != nil {
-		return "", fmt.Errorf("failed to read from NVMEM device %s at offset %d: %v", nvmemDevicePath, offset, err)
+	err := writeRedisOutput(ctx, cfg, conns, res)
+
+	// Secondary outputs run after Redis, whether or not it was written, so
+	// an unreachable broker or a full disk can never keep the fields out of
+	// the main store
+	if cfg.outputs["file"] {
+		if fileErr := emitOutputFile(cfg, fields); fileErr != nil {
+			slog.Warn("Failed to write output file", "path", cfg.outputFile, "error", fileErr)
+			err = errors.Join(err, fileErr)
+		}
+	}
+	if cfg.outputs["mqtt"] {
+		if mqttErr := emitMQTT(ctx, cfg, fields); mqttErr != nil {
+			slog.Warn("Failed to publish to MQTT", "broker", cfg.mqttBroker, "topic", cfg.mqttTopic, "error", mqttErr)
+			err = errors.Join(err, mqttErr)
+		}
 	}
-	if n != 4 {
-		return "", fmt.Errorf("unexpected number of bytes read from NVMEM device %s at offset %d: got %d, expected 4", nvmemDevicePath, offset, n)
+	if cfg.reportURL != "" {
+		if reportErr := emitReport(ctx, cfg, res); reportErr != nil {
+			slog.Warn("Failed to report serial numbers", "url", cfg.reportURL, "error", reportErr)
+			// Only -strict makes a failed report fail the run
+			if cfg.strict {
+				err = errors.Join(err, reportErr)
+			}
+		}
 	}
 
-	hexStr := fmt.Sprintf("%02x%02x%02x%02x", buffer[3], buffer[2], buffer[1], buffer[0])
-	return hexStr, nil
+	if err == nil && !cfg.dryRun {
+		metrics.lastSuccess.Store(time.Now().Unix())
+	}
+	return err
 }
 
-// parseHexFromString parses a hexadecimal string (expected without "0x" prefix) into a uint64.
-func parseHexFromString(hexStr string) (uint64, error) {
-	value, err := strconv.ParseUint(hexStr, 16, 64)
-	if err != nil {
-		return 0, fmt.Errorf("cannot parse hex string '%s': %v", hexStr, err)
+// emitOutputFile writes fields to -output-file, or logs what it would do in
+// a dry run.
+func emitOutputFile(cfg *config, fields *fieldSet) error {
+	if cfg.dryRun {
+		slog.Info("Dry run: would write output file", "path", cfg.outputFile)
+		return nil
+	}
+	if err := writeOutputFile(cfg.outputFile, fields); err != nil {
+		return err
 	}
-	return value, nil
+	slog.Debug("Wrote fields to output file", "path", cfg.outputFile)
+	return nil
 }
 
-// readOSRelease reads the /etc/os-release file and returns a map of lowercase keys to values
-func readOSRelease() (map[string]string, error) {
-	file, err := os.Open("/etc/os-release")
+// emitReport posts the serial numbers in res to -report-url, or logs why it
+// does not.
+func emitReport(ctx context.Context, cfg *config, res *collectResult) error {
+	switch {
+	case cfg.dryRun:
+		slog.Info("Dry run: would report serial numbers", "url", cfg.reportURL)
+	case res.serial.size() == 0 || res.serialErr != nil:
+		slog.Warn("Not reporting serial numbers, they could not be computed", "url", cfg.reportURL)
+	default:
+		if err := reportSerial(ctx, cfg, res); err != nil {
+			return err
+		}
+		slog.Debug("Reported serial numbers", "url", cfg.reportURL)
+	}
+	return nil
+}
+
+// emitMQTT publishes fields to -mqtt-broker, or logs what it would do in a
+// dry run.
+func emitMQTT(ctx context.Context, cfg *config, fields *fieldSet) error {
+	if cfg.dryRun {
+		slog.Info("Dry run: would publish to MQTT", "broker", cfg.mqttBroker, "topic", cfg.mqttTopic)
+		return nil
+	}
+	payload, err := json.Marshal(fields)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open /etc/os-release: %w", err)
+		return fmt.Errorf("failed to encode fields as JSON: %w", err)
+	}
+	if err := publishMQTT(ctx, cfg, payload); err != nil {
+		return err
+	}
+	slog.Debug("Published fields to MQTT", "broker", cfg.mqttBroker, "topic", cfg.mqttTopic)
+	return nil
+}
+
+// writeRedisOutput writes the fields in res to every Redis target, if the
+// output mode involves Redis.
+func writeRedisOutput(ctx context.Context, cfg *config, conns []redisConn, res *collectResult) error {
+	if !cfg.writesRedis() {
+		return nil
 	}
-	defer file.Close()
 
-	data := make(map[string]string)
-	scanner := bufio.NewScanner(file)
+	fields := res.fields
+	hashes := redisHashes(cfg, res)
+	if cfg.dryRun {
+		for _, h := range hashes {
+			h.fields.each(func(key, value string) {
+				if cfg.redisKeyMode == "keys" {
+					slog.Info("Dry run: would set key", "key", h.name+":"+key, "value", value)
+				} else {
+					slog.Info("Dry run: would set field", "hash", h.name, "field", key, "value", value)
+				}
+			})
+			if cfg.ttl > 0 {
+				slog.Info("Dry run: would set TTL", "hash", h.name, "ttl", cfg.ttl.String())
+			}
+		}
+		if cfg.notifyChannel != "" {
+			slog.Info("Dry run: would publish update notification", "channel", cfg.notifyChannel)
+		}
+		slog.Info("Dry run: fields not written to Redis", "hash", cfg.hashName, "count", fields.size())
+		return nil
+	}
 
-	for scanner.Scan() {
-		line := scanner.Text()
-		if line == "" || strings.HasPrefix(line, "#") {
+	// With several targets a failing one is only a warning, unless
+	// -redis-require-all is set, as long as another one was written
+	failed := 0
+	for i := range conns {
+		conn := &conns[i]
+		if err := writeTarget(ctx, cfg, conn, hashes); err != nil {
+			metrics.redisWriteErrors.Add(1)
+			if ctx.Err() != nil || len(conns) == 1 {
+				status.record(stepRedisWrite, err)
+				return fmt.Errorf("failed to write to Redis hash '%s': %w", cfg.hashName, err)
+			}
+			if cfg.redisRequireAll {
+				status.record(stepRedisWrite, err)
+				return fmt.Errorf("failed to write to Redis hash '%s' at %s: %w", cfg.hashName, conn.addr, err)
+			}
+			slog.Warn("Failed to write to Redis target", "hash", cfg.hashName, "redis_addr", conn.addr, "error", err)
+			failed++
 			continue
 		}
 
-		parts := strings.SplitN(line, "=", 2)
-		if len(parts) != 2 {
+		metrics.redisWrites.Add(1)
+		slog.Debug("Stored fields in Redis hash", "hash", cfg.hashName, "redis_addr", conn.addr, "count", fields.size())
+
+		// The hash is already authoritative, so a failed notification is not fatal
+		if cfg.notifyChannel != "" {
+			if err := publishUpdate(ctx, conn.rdb, cfg.notifyChannel, cfg.hashName); err != nil {
+				slog.Warn("Failed to publish update notification", "channel", cfg.notifyChannel, "redis_addr", conn.addr, "error", err)
+			}
+		}
+	}
+	if failed == len(conns) {
+		err := fmt.Errorf("failed to write to Redis hash '%s': all %d targets failed", cfg.hashName, failed)
+		status.record(stepRedisWrite, err)
+		return err
+	}
+
+	status.record(stepRedisWrite, nil)
+	return nil
+}
+
+// writeTarget writes hashes to one Redis target unless its circuit breaker
+// is open, and records the outcome with the breaker.
+func writeTarget(ctx context.Context, cfg *config, conn *redisConn, hashes []redisHash) error {
+	if err := conn.breaker.allow(clock()); err != nil {
+		return err
+	}
+	err := writeTargetOnce(ctx, cfg, conn, hashes)
+	if ctx.Err() == nil {
+		conn.breaker.record(cfg.breakerThreshold, cfg.breakerCooldown, conn.addr, err, clock())
+	}
+	return err
+}
+
+// writeTargetOnce writes hashes to one Redis target. In daemon mode a target
+// that was unreachable so far is reconnected first.
+func writeTargetOnce(ctx context.Context, cfg *config, conn *redisConn, hashes []redisHash) error {
+	if conn.rdb == nil {
+		if !cfg.daemon() {
+			return errors.New("not connected")
+		}
+		rdb, err := connectRedis(ctx, cfg, conn.addr)
+		if err != nil {
+			return err
+		}
+		conn.rdb = rdb
+	}
+
+	// Rewriting identical values every interval only causes traffic and
+	// keyspace notifications. Per-key TTLs in keys mode need every key
+	// rewritten, so that combination always writes in full.
+	if cfg.daemon() && !cfg.fullWrites && !(cfg.redisKeyMode == "keys" && cfg.ttl > 0) {
+		hashes = changedFields(ctx, conn.rdb, cfg, hashes)
+	}
+
+	err := retryRedisOp(ctx, cfg, "MULTI/EXEC", func() error {
+		return writeHashes(ctx, conn.rdb, cfg, hashes)
+	})
+	if err != nil || !cfg.verifyWrites {
+		return err
+	}
+	return verifyHashes(ctx, conn.rdb, cfg, hashes)
+}
+
+// changedFields reduces hashes to the fields whose stored value differs. If
+// a hash cannot be read it is written in full.
+func changedFields(ctx context.Context, rdb redis.UniversalClient, cfg *config, hashes []redisHash) []redisHash {
+	changed := make([]redisHash, 0, len(hashes))
+	for _, h := range hashes {
+		stored, err := readStoredFields(ctx, rdb, cfg, h.name)
+		if err != nil {
+			slog.Warn("Failed to read stored fields, writing all", "hash", h.name, "error", err)
+			changed = append(changed, h)
 			continue
 		}
 
-		key := strings.ToLower(parts[0])
-		value := strings.Trim(parts[1], "\"")
-		data[key] = value
+		delta := newFieldSet()
+		h.fields.each(func(key, value string) {
+			if storedValue, ok := stored[key]; !ok || storedValue != value {
+				delta.set(key, value)
+			}
+		})
+		slog.Debug("Writing changed fields", "hash", h.name, "written", delta.size(), "unchanged", h.fields.size()-delta.size())
+		changed = append(changed, redisHash{name: h.name, fields: delta, serial: h.serial})
 	}
+	return changed
+}
+
+// redisHash is a set of fields stored together in one Redis hash, or in
+// -redis-key-mode keys under one key prefix.
+type redisHash struct {
+	name   string
+	fields *fieldSet
+	// serial holds the fields that are serial number fields.
+	serial *fieldSet
+}
 
-	if err := scanner.Err(); err != nil {
-		return nil, fmt.Errorf("error reading /etc/os-release: %w", err)
+// preserved reports whether key must not overwrite an existing value, per
+// -no-overwrite or, for serial number fields, -no-overwrite-serial.
+func (h redisHash) preserved(cfg *config, key string) bool {
+	if _, ok := h.serial.get(key); ok {
+		return cfg.noOverwriteSerial
 	}
+	return cfg.noOverwrite
+}
 
-	return data, nil
+// redisHashes returns the hashes the fields in res are stored in: all of
+// them in cfg.hashName, or the serial fields in cfg.serialHash and the rest
+// in cfg.hashName when -serial-hash is set. In -redis-key-mode keys the main
+// hash name is replaced by cfg.redisKeyPrefix.
+func redisHashes(cfg *config, res *collectResult) []redisHash {
+	mainName := cfg.hashName
+	if cfg.redisKeyMode == "keys" {
+		mainName = cfg.redisKeyPrefix
+	}
+	if cfg.serialHash == "" {
+		return []redisHash{{name: mainName, fields: res.fields, serial: res.serialFields}}
+	}
+
+	main := newFieldSet()
+	res.fields.each(func(key, value string) {
+		if _, ok := res.serialFields.get(key); !ok {
+			main.set(key, value)
+		}
+	})
+	return []redisHash{
+		{name: mainName, fields: main, serial: newFieldSet()},
+		{name: cfg.serialHash, fields: res.serialFields, serial: res.serialFields},
+	}
 }
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/librescoot/version-service/pkg/versioninfo"
+	"github.com/redis/go-redis/v9"
+)
+
+// testOSRelease writes content to an os-release file and returns its path.
+func testOSRelease(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "os-release")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// collectTestFields validates args and runs collectFields with identifiers
+// from reader, or with -no-serial if reader is nil.
+func collectTestFields(t *testing.T, reader versioninfo.IdentifierReader, args ...string) *collectResult {
+	t.Helper()
+	if reader == nil {
+		args = append([]string{"-no-serial"}, args...)
+	}
+	cfg, err := validTestConfig(t, args...)
+	if err != nil {
+		t.Fatalf("validate %q: %v", args, err)
+	}
+	res, err := collectFields(cfg, reader)
+	if err != nil {
+		t.Fatalf("collectFields: %v", err)
+	}
+	return res
+}
+
+func TestLastUpdated(t *testing.T) {
+	pinned := time.Date(2024, 3, 1, 12, 30, 45, 0, time.FixedZone("CET", 3600))
+	oldClock := clock
+	clock = func() time.Time { return pinned }
+	t.Cleanup(func() { clock = oldClock })
+
+	path := testOSRelease(t, "VERSION_ID=1.0\n")
+	tests := []struct {
+		format, want string
+	}{
+		{"rfc3339", "2024-03-01T11:30:45Z"},
+		{"epoch", "1709292645"},
+	}
+	for _, tt := range tests {
+		if got := formatTimestamp(pinned, tt.format); got != tt.want {
+			t.Errorf("formatTimestamp(%s) = %q, want %q", tt.format, got, tt.want)
+		}
+		res := collectTestFields(t, nil, "-os-release-path", path, "-timestamp-format", tt.format)
+		if got, _ := res.fields.get("last_updated"); got != tt.want {
+			t.Errorf("%s: last_updated = %q, want %q", tt.format, got, tt.want)
+		}
+	}
+}
+
+// testIdentifiers returns a reader for CFG0 0a0b0c0d and CFG1 000000e1.
+func testIdentifiers() *staticReader {
+	return &staticReader{ids: versioninfo.Identifiers{
+		CFG0: "0a0b0c0d", CFG1: "000000e1",
+		CFG0Source: versioninfo.SourceNVMEM, CFG1Source: versioninfo.SourceNVMEM,
+	}}
+}
+
+func TestLegacySerialNumber(t *testing.T) {
+	path := testOSRelease(t, "VERSION_ID=1.0\n")
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-legacy-serial-mode", "sum"}, "168496366"},
+		{[]string{"-legacy-serial-mode", "sum", "-legacy-serial-base", "16"}, "a0b0cee"},
+		{[]string{"-legacy-serial-mode", "concat-decimal"}, "966536137741"},
+		{[]string{"-legacy-serial-mode", "concat-decimal", "-legacy-serial-base", "16"}, "e10a0b0c0d"},
+		// serial_number keeps lowercase hex whatever -serial-hex-case says
+		{[]string{"-legacy-serial-mode", "concat-decimal", "-legacy-serial-base", "16", "-serial-hex-case", "upper"}, "e10a0b0c0d"},
+		{[]string{"-legacy-serial-mode", "sum", "-legacy-serial-base", "16", "-serial-hex-case", "upper"}, "a0b0cee"},
+	}
+	for _, tt := range tests {
+		res := collectTestFields(t, testIdentifiers(), append(tt.args, "-os-release-path", path)...)
+		if got, _ := res.fields.get("serial_number"); got != tt.want {
+			t.Errorf("%q: serial_number = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+
+	res := collectTestFields(t, testIdentifiers(), "-os-release-path", path, "-serial-hex-case", "upper")
+	if got, _ := res.fields.get("serial_number_real"); got != "000000E10A0B0C0D" {
+		t.Errorf("upper case serial_number_real = %q", got)
+	}
+}
+
+func TestSerialNumberDisplay(t *testing.T) {
+	path := testOSRelease(t, "VERSION_ID=1.0\n")
+
+	res := collectTestFields(t, testIdentifiers(), "-os-release-path", path)
+	if got, _ := res.fields.get("serial_number_display"); got != "0000-00e1-0a0b-0c0d" {
+		t.Errorf("default serial_number_display = %q, want 0000-00e1-0a0b-0c0d", got)
+	}
+
+	res = collectTestFields(t, testIdentifiers(), "-os-release-path", path, "-serial-display-format", "XXXXXXXX XXXXXXXX", "-serial-hex-case", "upper")
+	if got, _ := res.fields.get("serial_number_display"); got != "000000E1 0A0B0C0D" {
+		t.Errorf("serial_number_display = %q, want 000000E1 0A0B0C0D", got)
+	}
+
+	res = collectTestFields(t, testIdentifiers(), "-os-release-path", path, "-serial-display-format", "")
+	if got, ok := res.fields.get("serial_number_display"); ok {
+		t.Errorf("serial_number_display stored with an empty mask: %q", got)
+	}
+}
+
+func TestKeyCase(t *testing.T) {
+	path := testOSRelease(t, "NAME=LibreScoot\nVERSION_ID=1.2\nID= LibreScoot \nBUILD_ID=7\n")
+	selection := []string{
+		"-os-release-path", path,
+		"-fields", "version_id,ID,name",
+		"-hash-field-rename", "VERSION_ID=os_version",
+		"-field-transform", "id=trim+lower",
+	}
+
+	tests := []struct {
+		name string
+		args []string
+		want map[string]string
+	}{
+		{"lowercase", nil, map[string]string{"name": "LibreScoot", "os_version": "1.2", "id": "librescoot"}},
+		{"preserved", []string{"-preserve-key-case"}, map[string]string{"NAME": "LibreScoot", "os_version": "1.2", "ID": "librescoot"}},
+	}
+	for _, tt := range tests {
+		res := collectTestFields(t, nil, append(tt.args, selection...)...)
+		if res.osReleaseFields != len(tt.want) {
+			t.Errorf("%s: %d os-release fields stored, want %d", tt.name, res.osReleaseFields, len(tt.want))
+		}
+		for key, want := range tt.want {
+			if got, ok := res.fields.get(key); !ok || got != want {
+				t.Errorf("%s: %s = %q (present %v), want %q", tt.name, key, got, ok, want)
+			}
+		}
+		for _, key := range []string{"build_id", "BUILD_ID", "version_id", "VERSION_ID"} {
+			if _, ok := res.fields.get(key); ok {
+				t.Errorf("%s: unexpected field %s", tt.name, key)
+			}
+		}
+	}
+}
+
+// hookedConns returns one Redis target whose commands are recorded by hook
+// instead of being sent.
+func hookedConns(t *testing.T, hook *recordingHook) []redisConn {
+	t.Helper()
+	rdb := redis.NewClient(&redis.Options{Addr: "127.0.0.1:0"})
+	rdb.AddHook(hook)
+	t.Cleanup(func() { rdb.Close() })
+	return []redisConn{{addr: "127.0.0.1:0", rdb: rdb}}
+}
+
+// wroteHash reports whether hook recorded an HSET of hash.
+func (h *recordingHook) wroteHash(hash string) bool {
+	for _, cmds := range h.pipelines {
+		for _, cmd := range cmds {
+			if args := cmd.Args(); cmd.Name() == "hset" && len(args) > 1 && args[1] == hash {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func TestEmitFieldsMQTTFailureStillWritesRedis(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A closed port: the broker is down
+	addr := ln.Addr().String()
+	ln.Close()
+
+	path := testOSRelease(t, "VERSION_ID=1.0\n")
+	res := collectTestFields(t, nil, "-os-release-path", path, "-mqtt-broker", addr)
+	cfg, _ := validTestConfig(t, "-os-release-path", path, "-mqtt-broker", addr)
+	hook := &recordingHook{}
+
+	err = emitFields(context.Background(), cfg, hookedConns(t, hook), res)
+	if err == nil {
+		t.Error("MQTT failure not reported")
+	}
+	if !hook.wroteHash(cfg.hashName) {
+		t.Errorf("hash not written, commands %v", hook.commandNames())
+	}
+}
+
+func TestEmitFieldsFileFailureStillWritesRedis(t *testing.T) {
+	path := testOSRelease(t, "VERSION_ID=1.0\n")
+	outputFile := filepath.Join(t.TempDir(), "missing-dir", "version.json")
+	res := collectTestFields(t, nil, "-os-release-path", path)
+	cfg, _ := validTestConfig(t, "-os-release-path", path, "-output-file", outputFile)
+	hook := &recordingHook{}
+
+	err := emitFields(context.Background(), cfg, hookedConns(t, hook), res)
+	if err == nil {
+		t.Error("output file failure not reported")
+	}
+	if !hook.wroteHash(cfg.hashName) {
+		t.Errorf("hash not written, commands %v", hook.commandNames())
+	}
+}
+
+func TestEmitFieldsStrictReportFailureStillWritesRedis(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "provisioning database down", http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	path := testOSRelease(t, "VERSION_ID=1.0\n")
+	args := []string{"-os-release-path", path, "-strict", "-report-url", server.URL}
+	res := collectTestFields(t, testIdentifiers(), args...)
+	cfg, _ := validTestConfig(t, args...)
+	hook := &recordingHook{}
+
+	err := emitFields(context.Background(), cfg, hookedConns(t, hook), res)
+	if err == nil {
+		t.Error("strict report failure not reported")
+	}
+	if !hook.wroteHash(cfg.hashName) {
+		t.Errorf("hash not written, commands %v", hook.commandNames())
+	}
+}
+
+func TestRenameOntoExistingField(t *testing.T) {
+	path := testOSRelease(t, "NAME=LibreScoot\nVERSION_ID=1.2\nBUILD_ID=7\n")
+	logs := captureLogs(t)
+
+	res := collectTestFields(t, nil, "-os-release-path", path, "-hash-field-rename", "version_id=name,build_id=build")
+	want := map[string]string{"name": "LibreScoot", "version_id": "1.2", "build": "7"}
+	for key, value := range want {
+		if got, _ := res.fields.get(key); got != value {
+			t.Errorf("%s = %q, want %q", key, got, value)
+		}
+	}
+	if n := len(logs.warnings("Not renaming os-release field onto an existing field")); n != 1 {
+		t.Errorf("got %d rename warnings, want 1", n)
+	}
+
+	// Renaming two keys onto each other's names is fine
+	res = collectTestFields(t, nil, "-os-release-path", path, "-hash-field-rename", "version_id=name,name=product")
+	if got, _ := res.fields.get("name"); got != "1.2" {
+		t.Errorf("swapped name = %q, want 1.2", got)
+	}
+
+	if _, err := validTestConfig(t, "-fields", "name,version_id", "-hash-field-rename", "version_id=name"); err == nil {
+		t.Error("rename onto a selected field accepted")
+	}
+}
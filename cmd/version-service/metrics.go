@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// serviceMetrics holds the counters exposed on -metrics-addr in the
+// Prometheus text exposition format.
+type serviceMetrics struct {
+	redisWrites          atomic.Uint64
+	redisWriteErrors     atomic.Uint64
+	identifierReadErrors atomic.Uint64
+	lastSuccess          atomic.Int64
+}
+
+var metrics serviceMetrics
+
+func (m *serviceMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintf(w, "# HELP versionservice_redis_writes_total Successful writes of the version hash.\n")
+	fmt.Fprintf(w, "# TYPE versionservice_redis_writes_total counter\n")
+	fmt.Fprintf(w, "versionservice_redis_writes_total %d\n", m.redisWrites.Load())
+	fmt.Fprintf(w, "# HELP versionservice_redis_write_errors_total Failed writes of the version hash.\n")
+	fmt.Fprintf(w, "# TYPE versionservice_redis_write_errors_total counter\n")
+	fmt.Fprintf(w, "versionservice_redis_write_errors_total %d\n", m.redisWriteErrors.Load())
+	fmt.Fprintf(w, "# HELP versionservice_identifier_read_errors_total Runs where a device identifier part could not be read.\n")
+	fmt.Fprintf(w, "# TYPE versionservice_identifier_read_errors_total counter\n")
+	fmt.Fprintf(w, "versionservice_identifier_read_errors_total %d\n", m.identifierReadErrors.Load())
+	fmt.Fprintf(w, "# HELP versionservice_last_success_timestamp_seconds Unix time of the last successful run.\n")
+	fmt.Fprintf(w, "# TYPE versionservice_last_success_timestamp_seconds gauge\n")
+	fmt.Fprintf(w, "versionservice_last_success_timestamp_seconds %d\n", m.lastSuccess.Load())
+}
+
+// startMetricsServer serves /metrics on addr until ctx is cancelled.
+func startMetricsServer(ctx context.Context, addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", &metrics)
+	serveHTTP(ctx, "metrics", addr, mux)
+}
+
+// serveHTTP runs an HTTP server for handler on addr in the background and
+// shuts it down when ctx is cancelled.
+func serveHTTP(ctx context.Context, name, addr string, handler http.Handler) {
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	go func() {
+		slog.Info("Serving HTTP", "server", name, "addr", addr)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("HTTP server failed", "server", name, "addr", addr, "error", err)
+		}
+	}()
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// MQTT 3.1.1 control packet types used by publishMQTT.
+const (
+	mqttConnect    = 0x10
+	mqttConnack    = 0x20
+	mqttPublish    = 0x30
+	mqttPuback     = 0x40
+	mqttDisconnect = 0xe0
+
+	mqttRetain = 0x01
+	mqttQoS1   = 0x02
+)
+
+// mqttPacketID identifies the single PUBLISH of a connection.
+const mqttPacketID = 1
+
+// publishMQTT connects to the broker, publishes payload to topic as a
+// retained QoS 1 message, waits for the PUBACK confirming the broker has
+// taken it and disconnects. Retaining the message lets late subscribers
+// receive the last known version information.
+func publishMQTT(ctx context.Context, cfg *config, payload []byte) error {
+	broker := strings.TrimPrefix(cfg.mqttBroker, "tcp://")
+	if _, _, err := net.SplitHostPort(broker); err != nil {
+		broker = net.JoinHostPort(broker, "1883")
+	}
+
+	dialer := net.Dialer{Timeout: 5 * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", broker)
+	if err != nil {
+		return fmt.Errorf("failed to connect to MQTT broker %s: %w", broker, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	clientID := fmt.Sprintf("version-service-%d", os.Getpid())
+	if err := writeMQTTPacket(conn, mqttConnect, mqttConnectBody(clientID, cfg.mqttUsername, cfg.mqttPassword)); err != nil {
+		return fmt.Errorf("failed to send CONNECT to %s: %w", broker, err)
+	}
+
+	header, ack, err := readMQTTPacket(conn)
+	if err != nil {
+		return fmt.Errorf("failed to read CONNACK from %s: %w", broker, err)
+	}
+	if header != mqttConnack || len(ack) != 2 {
+		return fmt.Errorf("unexpected reply from %s: packet type %#x, % x", broker, header, ack)
+	}
+	if ack[1] != 0 {
+		return fmt.Errorf("MQTT broker %s refused connection: return code %d", broker, ack[1])
+	}
+
+	if err := writeMQTTPacket(conn, mqttPublish|mqttQoS1|mqttRetain, mqttPublishBody(cfg.mqttTopic, mqttPacketID, payload)); err != nil {
+		return fmt.Errorf("failed to publish to %s: %w", cfg.mqttTopic, err)
+	}
+
+	header, ack, err = readMQTTPacket(conn)
+	if err != nil {
+		return fmt.Errorf("failed to read PUBACK from %s: %w", broker, err)
+	}
+	if header != mqttPuback || len(ack) != 2 || binary.BigEndian.Uint16(ack) != mqttPacketID {
+		return fmt.Errorf("unexpected reply to PUBLISH from %s: packet type %#x, % x", broker, header, ack)
+	}
+
+	return writeMQTTPacket(conn, mqttDisconnect, nil)
+}
+
+// mqttPublishBody builds the variable header and payload of a QoS 1 PUBLISH
+// packet.
+func mqttPublishBody(topic string, packetID uint16, payload []byte) []byte {
+	var body bytes.Buffer
+	writeMQTTString(&body, topic)
+	binary.Write(&body, binary.BigEndian, packetID)
+	body.Write(payload)
+	return body.Bytes()
+}
+
+// mqttConnectBody builds the variable header and payload of a clean-session
+// CONNECT packet.
+func mqttConnectBody(clientID, username, password string) []byte {
+	var flags byte = 0x02 // clean session
+	if username != "" {
+		flags |= 0x80
+		if password != "" {
+			flags |= 0x40
+		}
+	}
+
+	var body bytes.Buffer
+	writeMQTTString(&body, "MQTT")
+	body.WriteByte(4) // protocol level 3.1.1
+	body.WriteByte(flags)
+	binary.Write(&body, binary.BigEndian, uint16(30)) // keep alive seconds
+	writeMQTTString(&body, clientID)
+	if username != "" {
+		writeMQTTString(&body, username)
+		if password != "" {
+			writeMQTTString(&body, password)
+		}
+	}
+	return body.Bytes()
+}
+
+// writeMQTTPacket writes a control packet with its variable-length
+// remaining-length header.
+func writeMQTTPacket(w io.Writer, header byte, body []byte) error {
+	packet := []byte{header}
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		packet = append(packet, b)
+		if n == 0 {
+			break
+		}
+	}
+	_, err := w.Write(append(packet, body...))
+	return err
+}
+
+// readMQTTPacket reads one control packet and returns its first header byte
+// and its body.
+func readMQTTPacket(r io.Reader) (byte, []byte, error) {
+	var b [1]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return 0, nil, err
+	}
+	header := b[0]
+
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		if i == 4 {
+			return 0, nil, errors.New("malformed remaining length")
+		}
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return 0, nil, err
+		}
+		length += int(b[0]&0x7f) * multiplier
+		multiplier *= 128
+		if b[0]&0x80 == 0 {
+			break
+		}
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return header, body, nil
+}
+
+// writeMQTTString writes s as a length-prefixed UTF-8 string.
+func writeMQTTString(buf *bytes.Buffer, s string) {
+	binary.Write(buf, binary.BigEndian, uint16(len(s)))
+	buf.WriteString(s)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestWriteMQTTPacketRemainingLength(t *testing.T) {
+	tests := []struct {
+		length int
+		want   []byte
+	}{
+		{0, []byte{0x00}},
+		{127, []byte{0x7f}},
+		{128, []byte{0x80, 0x01}},
+		{16383, []byte{0xff, 0x7f}},
+		{16384, []byte{0x80, 0x80, 0x01}},
+		{2097151, []byte{0xff, 0xff, 0x7f}},
+		{2097152, []byte{0x80, 0x80, 0x80, 0x01}},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		body := bytes.Repeat([]byte{'x'}, tt.length)
+		if err := writeMQTTPacket(&buf, mqttPublish, body); err != nil {
+			t.Fatalf("length %d: %v", tt.length, err)
+		}
+		packet := buf.Bytes()
+		if got := packet[1 : 1+len(tt.want)]; !bytes.Equal(got, tt.want) {
+			t.Errorf("length %d: remaining length % x, want % x", tt.length, got, tt.want)
+		}
+		if len(packet) != 1+len(tt.want)+tt.length {
+			t.Errorf("length %d: packet is %d bytes, want %d", tt.length, len(packet), 1+len(tt.want)+tt.length)
+		}
+
+		header, gotBody, err := readMQTTPacket(bytes.NewReader(packet))
+		if err != nil {
+			t.Fatalf("length %d: readMQTTPacket: %v", tt.length, err)
+		}
+		if header != mqttPublish || len(gotBody) != tt.length {
+			t.Errorf("length %d: read back header %#x with %d bytes", tt.length, header, len(gotBody))
+		}
+	}
+}
+
+func TestReadMQTTPacketMalformedLength(t *testing.T) {
+	_, _, err := readMQTTPacket(bytes.NewReader([]byte{mqttPuback, 0x80, 0x80, 0x80, 0x80, 0x01}))
+	if err == nil {
+		t.Fatal("five-byte remaining length accepted")
+	}
+}
+
+func TestMQTTConnectBodyFlags(t *testing.T) {
+	tests := []struct {
+		username, password string
+		flags              byte
+	}{
+		{"", "", 0x02},
+		{"scooter", "", 0x82},
+		{"scooter", "secret", 0xc2},
+	}
+	for _, tt := range tests {
+		body := mqttConnectBody("id", tt.username, tt.password)
+		// "MQTT" with its length prefix, then the protocol level
+		if got := body[7]; got != tt.flags {
+			t.Errorf("user %q password %q: flags %#x, want %#x", tt.username, tt.password, got, tt.flags)
+		}
+	}
+}
+
+// fakeBroker accepts one connection on a loopback listener, answers it like
+// an MQTT broker and sends the received PUBLISH packet on the returned
+// channel. With ack false it does not acknowledge the PUBLISH.
+func fakeBroker(t *testing.T, ack bool) (string, <-chan []byte) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	published := make(chan []byte, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		if header, _, err := readMQTTPacket(conn); err != nil || header != mqttConnect {
+			return
+		}
+		writeMQTTPacket(conn, mqttConnack, []byte{0, 0})
+
+		header, body, err := readMQTTPacket(conn)
+		if err != nil {
+			return
+		}
+		published <- append([]byte{header}, body...)
+		if ack {
+			writeMQTTPacket(conn, mqttPuback, []byte{0, mqttPacketID})
+			readMQTTPacket(conn) // DISCONNECT
+		}
+	}()
+	return ln.Addr().String(), published
+}
+
+func TestPublishMQTTQoS1(t *testing.T) {
+	addr, published := fakeBroker(t, true)
+	cfg := &config{mqttBroker: addr, mqttTopic: "librescoot/version"}
+	payload := []byte(`{"version_id":"1.2"}`)
+
+	if err := publishMQTT(context.Background(), cfg, payload); err != nil {
+		t.Fatalf("publishMQTT: %v", err)
+	}
+
+	packet := <-published
+	if want := byte(mqttPublish | mqttQoS1 | mqttRetain); packet[0] != want {
+		t.Errorf("PUBLISH header %#x, want %#x", packet[0], want)
+	}
+	body := packet[1:]
+	topicLen := int(binary.BigEndian.Uint16(body))
+	if topic := string(body[2 : 2+topicLen]); topic != cfg.mqttTopic {
+		t.Errorf("topic %q, want %q", topic, cfg.mqttTopic)
+	}
+	if id := binary.BigEndian.Uint16(body[2+topicLen:]); id != mqttPacketID {
+		t.Errorf("packet identifier %d, want %d", id, mqttPacketID)
+	}
+	if got := body[4+topicLen:]; !bytes.Equal(got, payload) {
+		t.Errorf("payload %q, want %q", got, payload)
+	}
+}
+
+func TestPublishMQTTWithoutPuback(t *testing.T) {
+	addr, _ := fakeBroker(t, false)
+	cfg := &config{mqttBroker: addr, mqttTopic: "librescoot/version"}
+
+	err := publishMQTT(context.Background(), cfg, []byte("{}"))
+	if err == nil || !strings.Contains(err.Error(), "PUBACK") {
+		t.Fatalf("publishMQTT without PUBACK: got %v, want a PUBACK error", err)
+	}
+}
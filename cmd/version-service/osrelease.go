@@ -0,0 +1,26 @@
+package main
+
+import "github.com/librescoot/version-service/pkg/versioninfo"
+
+// loadOSRelease reads os-release with versioninfo.LoadOSRelease and returns
+// its fields in file order.
+func loadOSRelease(path string, opts versioninfo.OSReleaseOptions) (*fieldSet, string, error) {
+	fields, usedPath, err := versioninfo.LoadOSRelease(path, opts)
+	if err != nil {
+		return nil, usedPath, err
+	}
+	data := newFieldSet()
+	for _, f := range fields {
+		data.set(f.Key, f.Value)
+	}
+	return data, usedPath, nil
+}
+
+// osReleaseDigest returns the versioninfo.OSReleaseDigest of data.
+func osReleaseDigest(data *fieldSet) string {
+	fields := make([]versioninfo.Field, 0, data.size())
+	data.each(func(key, value string) {
+		fields = append(fields, versioninfo.Field{Key: key, Value: value})
+	})
+	return versioninfo.OSReleaseDigest(fields)
+}
@@ -0,0 +1,566 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisConn is one Redis target. rdb is nil while the target has not been
+// reached yet.
+type redisConn struct {
+	addr    string
+	rdb     redis.UniversalClient
+	breaker circuitBreaker
+}
+
+// connectRedisTargets connects to every Redis target. A single target must
+// be reachable. Of several, unreachable ones are logged, and retried on each
+// write in daemon mode, unless -redis-require-all makes them an error.
+func connectRedisTargets(ctx context.Context, cfg *config) ([]redisConn, error) {
+	if len(cfg.redisAddrs) <= 1 {
+		rdb, err := connectRedis(ctx, cfg, cfg.redisAddr)
+		if err != nil {
+			return nil, err
+		}
+		return []redisConn{{addr: cfg.redisTarget(), rdb: rdb}}, nil
+	}
+
+	conns := make([]redisConn, 0, len(cfg.redisAddrs))
+	for _, addr := range cfg.redisAddrs {
+		rdb, err := connectRedis(ctx, cfg, addr)
+		if err != nil {
+			if ctx.Err() != nil || cfg.redisRequireAll {
+				closeRedisTargets(conns)
+				return nil, err
+			}
+			slog.Warn("Failed to connect to Redis target", "redis_addr", addr, "error", err)
+		}
+		conns = append(conns, redisConn{addr: addr, rdb: rdb})
+	}
+	return conns, nil
+}
+
+// closeRedisTargets closes the clients of all connected targets.
+func closeRedisTargets(conns []redisConn) {
+	for _, conn := range conns {
+		if conn.rdb != nil {
+			conn.rdb.Close()
+		}
+	}
+}
+
+// pingRedisTargets checks each target with PING. A target that does not
+// answer has its client replaced by a fresh connection, or dropped for
+// writeTarget to retry if that fails too. The outcome is recorded for the
+// readiness check with the same tolerance as writes.
+func pingRedisTargets(ctx context.Context, cfg *config, conns []redisConn) {
+	var failed []string
+	for i := range conns {
+		conn := &conns[i]
+		if err := conn.breaker.allow(clock()); err != nil {
+			failed = append(failed, conn.addr)
+			continue
+		}
+		if conn.rdb != nil {
+			err := conn.rdb.Ping(ctx).Err()
+			if err == nil || ctx.Err() != nil {
+				continue
+			}
+			slog.Warn("Redis did not answer PING, reconnecting", "redis_addr", conn.addr, "error", err)
+			conn.rdb.Close()
+			conn.rdb = nil
+		}
+
+		rdb, err := connectRedis(ctx, cfg, conn.addr)
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.Warn("Failed to reconnect to Redis", "redis_addr", conn.addr, "error", err)
+			}
+			failed = append(failed, conn.addr)
+			continue
+		}
+		slog.Info("Reconnected to Redis", "redis_addr", conn.addr)
+		conn.rdb = rdb
+	}
+
+	if ctx.Err() != nil {
+		return
+	}
+	if len(failed) > 0 && (len(failed) == len(conns) || cfg.redisRequireAll) {
+		status.record(stepRedisPing, fmt.Errorf("no connection to %s", strings.Join(failed, ", ")))
+		return
+	}
+	status.record(stepRedisPing, nil)
+}
+
+// connectRedis creates the Redis client from cfg and waits until the server
+// answers. addr is the server address unless cfg selects a URL, Sentinels
+// or a cluster. Authentication and TLS failures are reported distinctly.
+func connectRedis(ctx context.Context, cfg *config, addr string) (redis.UniversalClient, error) {
+	password, err := resolveRedisPassword(cfg.redisPassword, cfg.redisPasswordFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read password: %w", err)
+	}
+
+	var tlsConfig *tls.Config
+	if cfg.redisTLS || cfg.redisURLOptions != nil && cfg.redisURLOptions.TLSConfig != nil {
+		tlsConfig, err = buildTLSConfig(cfg.redisCACert, cfg.redisClientCert, cfg.redisClientKey, cfg.redisTLSSkipVerify)
+		if err != nil {
+			return nil, fmt.Errorf("failed to configure TLS: %w", err)
+		}
+	}
+
+	target := cfg.redisTarget()
+	var rdb redis.UniversalClient
+	if len(cfg.clusterAddrs) > 0 {
+		// The cluster client follows MOVED/ASK redirects between shards
+		rdb = redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:        cfg.clusterAddrs,
+			Password:     password,
+			ClientName:   cfg.redisClientName,
+			TLSConfig:    tlsConfig,
+			DialTimeout:  5 * time.Second,
+			ReadTimeout:  3 * time.Second,
+			WriteTimeout: 3 * time.Second,
+		})
+	} else if len(cfg.sentinelAddrs) > 0 {
+		// The failover client asks the sentinels for the current master
+		// and follows it across failovers
+		rdb = redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:    cfg.masterName,
+			SentinelAddrs: cfg.sentinelAddrs,
+			Password:      password,
+			DB:            cfg.redisDB,
+			ClientName:    cfg.redisClientName,
+			TLSConfig:     tlsConfig,
+			DialTimeout:   5 * time.Second,
+			ReadTimeout:   3 * time.Second,
+			WriteTimeout:  3 * time.Second,
+		})
+	} else if cfg.redisURLOptions != nil {
+		// The URL takes precedence over the individual flags; only settings
+		// a URL cannot carry, like the password file and certificates, apply
+		opts := *cfg.redisURLOptions
+		if opts.Password == "" {
+			opts.Password = password
+		}
+		if opts.ClientName == "" {
+			opts.ClientName = cfg.redisClientName
+		}
+		if tlsConfig != nil {
+			if opts.TLSConfig != nil {
+				tlsConfig.ServerName = opts.TLSConfig.ServerName
+			}
+			opts.TLSConfig = tlsConfig
+		}
+		rdb = redis.NewClient(&opts)
+	} else {
+		target = addr
+		rdb = redis.NewClient(&redis.Options{
+			Addr:         addr,
+			Password:     password,
+			DB:           cfg.redisDB,
+			ClientName:   cfg.redisClientName,
+			TLSConfig:    tlsConfig,
+			DialTimeout:  5 * time.Second,
+			ReadTimeout:  3 * time.Second,
+			WriteTimeout: 3 * time.Second,
+		})
+	}
+
+	attempts, err := waitForRedis(ctx, rdb, cfg.connectTimeout, cfg.connectRetryInterval)
+	if err != nil {
+		rdb.Close()
+		if password != "" && isAuthError(err) {
+			return nil, fmt.Errorf("authentication failed at %s: %w", target, err)
+		}
+		if tlsConfig != nil && isTLSError(err) {
+			return nil, fmt.Errorf("TLS handshake failed with %s: %w", target, err)
+		}
+		return nil, fmt.Errorf("no response from %s after %d attempt(s): %w", target, attempts, err)
+	}
+
+	return rdb, nil
+}
+
+// updateNotification is the payload published to -notify-channel after the
+// hash has been written.
+type updateNotification struct {
+	Hash      string `json:"hash"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// publishUpdate announces on channel that hashName has been (re)written.
+func publishUpdate(ctx context.Context, rdb redis.UniversalClient, channel, hashName string) error {
+	payload, err := json.Marshal(updateNotification{
+		Hash:      hashName,
+		Timestamp: time.Now().Unix(),
+	})
+	if err != nil {
+		return err
+	}
+	return rdb.Publish(ctx, channel, payload).Err()
+}
+
+// waitForRedis pings Redis until it answers or the timeout elapses, sleeping
+// retryInterval between attempts. A zero timeout means a single attempt.
+// Authentication and TLS failures are not retried since they won't resolve
+// on their own. It returns the number of attempts made.
+func waitForRedis(ctx context.Context, rdb redis.UniversalClient, timeout, retryInterval time.Duration) (int, error) {
+	deadline := time.Now().Add(timeout)
+	attempts := 0
+	for {
+		attempts++
+		err := rdb.Ping(ctx).Err()
+		if err == nil {
+			return attempts, nil
+		}
+		if isAuthError(err) || isTLSError(err) || time.Now().Add(retryInterval).After(deadline) {
+			return attempts, err
+		}
+		slog.Debug("Redis not ready, retrying", "attempt", attempts, "retry_in", retryInterval.String(), "error", err)
+		select {
+		case <-time.After(retryInterval):
+		case <-ctx.Done():
+			return attempts, ctx.Err()
+		}
+	}
+}
+
+// writeHashes stores the hashes, and the TTL if configured, in a single
+// MULTI/EXEC transaction so consumers never observe a half-updated hash. In
+// -redis-key-mode keys every field becomes its own name:field string key
+// carrying the TTL. Fields covered by -no-overwrite or -no-overwrite-serial
+// are only set if they don't exist yet, and the skipped ones are logged. On
+// failure the error names the command that failed.
+func writeHashes(ctx context.Context, rdb redis.UniversalClient, cfg *config, hashes []redisHash) error {
+	type conditionalSet struct {
+		hash  string
+		field string
+		cmd   *redis.BoolCmd
+	}
+	var conditional []conditionalSet
+
+	cmds, err := rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, h := range hashes {
+			unconditional := newFieldSet()
+			h.fields.each(func(key, value string) {
+				if !h.preserved(cfg, key) {
+					unconditional.set(key, value)
+					return
+				}
+				var cmd *redis.BoolCmd
+				if cfg.redisKeyMode == "keys" {
+					cmd = pipe.SetNX(ctx, h.name+":"+key, value, cfg.ttl)
+				} else {
+					cmd = pipe.HSetNX(ctx, h.name, key, value)
+				}
+				conditional = append(conditional, conditionalSet{hash: h.name, field: key, cmd: cmd})
+			})
+
+			if cfg.redisKeyMode == "keys" {
+				unconditional.each(func(key, value string) {
+					pipe.Set(ctx, h.name+":"+key, value, cfg.ttl)
+				})
+				continue
+			}
+			// One multi-pair HSET per hash, serial fields included, rather
+			// than a round-trip per field
+			if unconditional.size() > 0 {
+				pipe.HSet(ctx, h.name, unconditional.hsetArgs()...)
+			}
+			// The TTL applies to the whole hash key; per-field expiry needs Redis 7.4
+			if cfg.ttl > 0 {
+				pipe.Expire(ctx, h.name, cfg.ttl)
+			}
+		}
+		return nil
+	})
+	if err := txError(cmds, err); err != nil {
+		// A command rejected by the server, e.g. for an oversized value,
+		// should not cost every other field
+		var redisErr redis.Error
+		if errors.As(err, &redisErr) {
+			slog.Warn("Redis transaction failed, writing fields one by one", "error", err)
+			return writeFieldsSeparately(ctx, rdb, cfg, hashes)
+		}
+		return err
+	}
+
+	for _, c := range conditional {
+		if !c.cmd.Val() {
+			slog.Info("Field already exists, not overwritten", "hash", c.hash, "field", c.field)
+		}
+	}
+	return nil
+}
+
+// verifyHashes reads hashes back after they were written and reports every
+// field that is missing or holds a different value, which catches data lost
+// to eviction or a failover. A field under -no-overwrite or
+// -no-overwrite-serial may keep its older value and only has to exist.
+func verifyHashes(ctx context.Context, rdb redis.UniversalClient, cfg *config, hashes []redisHash) error {
+	var mismatched []string
+	for _, h := range hashes {
+		stored, err := readStoredFields(ctx, rdb, cfg, h.name)
+		if err != nil {
+			return fmt.Errorf("failed to read back %s: %w", h.name, err)
+		}
+		h.fields.each(func(key, value string) {
+			storedValue, ok := stored[key]
+			switch {
+			case !ok:
+				slog.Warn("Written field missing on read-back", "hash", h.name, "field", key)
+			case storedValue != value && !h.preserved(cfg, key):
+				slog.Warn("Written field differs on read-back", "hash", h.name, "field", key, "written", value, "stored", storedValue)
+			default:
+				return
+			}
+			mismatched = append(mismatched, h.name+":"+key)
+		})
+	}
+	if len(mismatched) > 0 {
+		return fmt.Errorf("read-back verification failed for %s", strings.Join(mismatched, ", "))
+	}
+	return nil
+}
+
+// fieldWriteError reports the fields that Redis rejected while the others
+// were written.
+type fieldWriteError struct {
+	// failed holds the rejected fields as hash:field.
+	failed []string
+	// serial is set when a serial number field was among them.
+	serial bool
+	total  int
+}
+
+func (e *fieldWriteError) Error() string {
+	return fmt.Sprintf("%d of %d fields not written: %s", len(e.failed), e.total, strings.Join(e.failed, ", "))
+}
+
+// writeFieldsSeparately writes every field of hashes with its own command in
+// one pipeline, so a field the server rejects does not keep the others from
+// being written. Rejected fields are logged and returned as a
+// *fieldWriteError; a connection error is returned as is.
+func writeFieldsSeparately(ctx context.Context, rdb redis.UniversalClient, cfg *config, hashes []redisHash) error {
+	type fieldCmd struct {
+		hash, field string
+		serial      bool
+		cmd         redis.Cmder
+	}
+	var sent []fieldCmd
+
+	cmds, err := rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, h := range hashes {
+			h.fields.each(func(key, value string) {
+				_, serial := h.serial.get(key)
+				preserve := h.preserved(cfg, key)
+				var cmd redis.Cmder
+				switch {
+				case cfg.redisKeyMode == "keys" && preserve:
+					cmd = pipe.SetNX(ctx, h.name+":"+key, value, cfg.ttl)
+				case cfg.redisKeyMode == "keys":
+					cmd = pipe.Set(ctx, h.name+":"+key, value, cfg.ttl)
+				case preserve:
+					cmd = pipe.HSetNX(ctx, h.name, key, value)
+				default:
+					cmd = pipe.HSet(ctx, h.name, key, value)
+				}
+				sent = append(sent, fieldCmd{hash: h.name, field: key, serial: serial, cmd: cmd})
+			})
+			if cfg.redisKeyMode != "keys" && cfg.ttl > 0 {
+				pipe.Expire(ctx, h.name, cfg.ttl)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		var redisErr redis.Error
+		for _, cmd := range cmds {
+			if cmdErr := cmd.Err(); cmdErr != nil && !errors.As(cmdErr, &redisErr) {
+				return fmt.Errorf("%s failed: %w", strings.ToUpper(cmd.Name()), cmdErr)
+			}
+		}
+	}
+
+	fieldErr := &fieldWriteError{total: len(sent)}
+	for _, f := range sent {
+		if cmdErr := f.cmd.Err(); cmdErr != nil {
+			slog.Warn("Failed to write field", "hash", f.hash, "field", f.field, "error", cmdErr)
+			fieldErr.failed = append(fieldErr.failed, f.hash+":"+f.field)
+			fieldErr.serial = fieldErr.serial || f.serial
+		} else if set, ok := f.cmd.(*redis.BoolCmd); ok && !set.Val() {
+			slog.Info("Field already exists, not overwritten", "hash", f.hash, "field", f.field)
+		}
+	}
+	if len(fieldErr.failed) > 0 {
+		return fieldErr
+	}
+	return nil
+}
+
+// txError attributes a failed transaction to the first command that failed.
+func txError(cmds []redis.Cmder, err error) error {
+	if err == nil {
+		return nil
+	}
+	for _, cmd := range cmds {
+		if cmdErr := cmd.Err(); cmdErr != nil {
+			return fmt.Errorf("%s failed: %w", strings.ToUpper(cmd.Name()), cmdErr)
+		}
+	}
+	return err
+}
+
+// retryRedisOp runs op, retrying up to cfg.redisOpRetries more times with
+// exponential backoff starting at cfg.redisOpBackoff. It gives up early when
+// ctx is cancelled.
+func retryRedisOp(ctx context.Context, cfg *config, name string, op func() error) error {
+	backoff := cfg.redisOpBackoff
+	for attempt := 0; ; attempt++ {
+		err := op()
+		if err == nil || attempt >= cfg.redisOpRetries || ctx.Err() != nil {
+			return err
+		}
+		slog.Warn("Redis operation failed, retrying", "op", name, "attempt", attempt+1, "retry_in", backoff.String(), "error", err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return err
+		}
+		backoff *= 2
+	}
+}
+
+// resolveRedisPassword returns the Redis password from, in order of precedence,
+// the -redis-password flag, the -redis-password-file flag, or the REDIS_PASSWORD
+// environment variable. An empty string means no authentication.
+func resolveRedisPassword(password, passwordFile string) (string, error) {
+	if password != "" {
+		return password, nil
+	}
+	if passwordFile != "" {
+		data, err := os.ReadFile(passwordFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read password file %s: %w", passwordFile, err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+	return os.Getenv("REDIS_PASSWORD"), nil
+}
+
+// isAuthError reports whether err is a Redis authentication rejection.
+func isAuthError(err error) bool {
+	msg := err.Error()
+	return strings.HasPrefix(msg, "WRONGPASS") || strings.HasPrefix(msg, "NOAUTH") ||
+		strings.Contains(msg, "AUTH") && strings.Contains(msg, "without any password configured")
+}
+
+// buildTLSConfig assembles the TLS configuration for the Redis connection.
+// The CA certificate is optional (system roots are used when empty), and the
+// client certificate and key must be given together.
+func buildTLSConfig(caCertPath, clientCertPath, clientKeyPath string, skipVerify bool) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: skipVerify,
+	}
+
+	if caCertPath != "" {
+		caPEM, err := os.ReadFile(caCertPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA certificate %s: %w", caCertPath, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no valid certificates found in %s", caCertPath)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if (clientCertPath == "") != (clientKeyPath == "") {
+		return nil, fmt.Errorf("-redis-client-cert and -redis-client-key must be specified together")
+	}
+	if clientCertPath != "" {
+		cert, err := tls.LoadX509KeyPair(clientCertPath, clientKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// isTLSError reports whether err originates from the TLS handshake rather
+// than from Redis itself.
+func isTLSError(err error) bool {
+	var recordErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	var verifyErr *tls.CertificateVerificationError
+	var unknownAuthErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	return errors.As(err, &recordErr) || errors.As(err, &alertErr) ||
+		errors.As(err, &verifyErr) || errors.As(err, &unknownAuthErr) ||
+		errors.As(err, &hostnameErr) || errors.As(err, &invalidErr) ||
+		strings.Contains(err.Error(), "tls: ")
+}
+
+// scanFieldKeys returns the name:field keys -redis-key-mode keys stores for
+// name. name is glob-escaped so that only its own keys match, and on a
+// cluster every master is scanned since SCAN only covers one node.
+func scanFieldKeys(ctx context.Context, rdb redis.UniversalClient, name string) ([]string, error) {
+	pattern := escapeGlob(name) + ":*"
+	cluster, ok := rdb.(*redis.ClusterClient)
+	if !ok {
+		return scanKeys(ctx, rdb, pattern)
+	}
+
+	var mu sync.Mutex
+	var keys []string
+	err := cluster.ForEachMaster(ctx, func(ctx context.Context, node *redis.Client) error {
+		nodeKeys, err := scanKeys(ctx, node, pattern)
+		mu.Lock()
+		keys = append(keys, nodeKeys...)
+		mu.Unlock()
+		return err
+	})
+	sort.Strings(keys)
+	return keys, err
+}
+
+// scanKeys returns the keys of one node matching pattern.
+func scanKeys(ctx context.Context, rdb redis.Cmdable, pattern string) ([]string, error) {
+	var keys []string
+	iter := rdb.Scan(ctx, 0, pattern, 100).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	return keys, iter.Err()
+}
+
+// escapeGlob escapes the characters that are special in a Redis glob
+// pattern, so s only matches itself.
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`*?[]\`, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// recordingHook records the commands of every pipeline and transaction
+// instead of sending them, so tests need no Redis server.
+type recordingHook struct {
+	pipelines [][]redis.Cmder
+}
+
+func (h *recordingHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (h *recordingHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		h.pipelines = append(h.pipelines, []redis.Cmder{cmd})
+		return nil
+	}
+}
+
+func (h *recordingHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		h.pipelines = append(h.pipelines, cmds)
+		return nil
+	}
+}
+
+// commandNames returns the command names of every recorded pipeline in order.
+func (h *recordingHook) commandNames() []string {
+	var names []string
+	for _, cmds := range h.pipelines {
+		for _, cmd := range cmds {
+			names = append(names, cmd.Name())
+		}
+	}
+	return names
+}
+
+func TestWriteHashesSingleHSET(t *testing.T) {
+	hook := &recordingHook{}
+	rdb := redis.NewClient(&redis.Options{Addr: "127.0.0.1:0"})
+	rdb.AddHook(hook)
+	defer rdb.Close()
+
+	fields := newFieldSet()
+	fields.set("version_id", "1.2")
+	fields.set("name", "LibreScoot")
+	fields.set("serial_number", "168496366")
+	serial := newFieldSet()
+	serial.set("serial_number", "168496366")
+
+	cfg := &config{}
+	if err := writeHashes(context.Background(), rdb, cfg, []redisHash{{name: "version:mdb", fields: fields, serial: serial}}); err != nil {
+		t.Fatalf("writeHashes: %v", err)
+	}
+
+	var hsets []redis.Cmder
+	for _, cmds := range hook.pipelines {
+		for _, cmd := range cmds {
+			if cmd.Name() == "hset" {
+				hsets = append(hsets, cmd)
+			}
+		}
+	}
+	if len(hsets) != 1 {
+		t.Fatalf("got commands %v, want a single HSET", hook.commandNames())
+	}
+	want := []interface{}{"hset", "version:mdb", "version_id", "1.2", "name", "LibreScoot", "serial_number", "168496366"}
+	args := hsets[0].Args()
+	if len(args) != len(want) {
+		t.Fatalf("HSET args %v, want %v", args, want)
+	}
+	for i := range want {
+		if args[i] != want[i] {
+			t.Errorf("HSET args %v, want %v", args, want)
+			break
+		}
+	}
+}
+
+func TestEscapeGlob(t *testing.T) {
+	tests := map[string]string{
+		"version:mdb":   "version:mdb",
+		"{version}:mdb": "{version}:mdb",
+		"ver*sion":      `ver\*sion`,
+		"v?[ab]":        `v\?\[ab\]`,
+		`back\slash`:    `back\\slash`,
+	}
+	for in, want := range tests {
+		if got := escapeGlob(in); got != want {
+			t.Errorf("escapeGlob(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestResetKeysDryRun(t *testing.T) {
+	hook := &recordingHook{}
+	rdb := redis.NewClient(&redis.Options{Addr: "127.0.0.1:0"})
+	rdb.AddHook(hook)
+	defer rdb.Close()
+
+	for _, mode := range []string{"hash", "keys"} {
+		hook.pipelines = nil
+		scanned := false
+		cfg := &config{dryRun: true, redisKeyMode: mode}
+		if _, err := resetKeys(context.Background(), redisConn{addr: "test", rdb: rdb}, cfg, "ver*sion"); err != nil {
+			t.Fatalf("%s: %v", mode, err)
+		}
+		for _, cmds := range hook.pipelines {
+			for _, cmd := range cmds {
+				switch cmd.Name() {
+				case "del", "unlink":
+					t.Errorf("%s: dry run sent %v", mode, cmd.Args())
+				case "scan":
+					scanned = true
+					if args := cmd.Args(); args[3] != `ver\*sion:*` {
+						t.Errorf("%s: SCAN pattern %v, want ver\\*sion:*", mode, args[3])
+					}
+				}
+			}
+		}
+		if scanned != (mode == "keys") {
+			t.Errorf("%s: scanned %v", mode, scanned)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// serialReport is the body POSTed to -report-url.
+type serialReport struct {
+	Serial         *fieldSet `json:"serial"`
+	VersionID      string    `json:"version_id,omitempty"`
+	ImageVersion   string    `json:"image_version,omitempty"`
+	ServiceVersion string    `json:"service_version"`
+}
+
+// reportSerial POSTs the serial numbers and os-release version in res as
+// JSON to cfg.reportURL, adding the -report-auth-header if set. A response
+// other than 2xx is an error.
+func reportSerial(ctx context.Context, cfg *config, res *collectResult) error {
+	report := serialReport{Serial: res.serial, ServiceVersion: version}
+	report.VersionID, _ = res.osRelease.getFold("version_id")
+	if cfg.versionCompareKey != "" {
+		report.ImageVersion, _ = res.osRelease.getFold(cfg.versionCompareKey)
+	}
+	body, err := json.Marshal(report)
+	if err != nil {
+		return fmt.Errorf("failed to encode report: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.reportURL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("invalid report URL: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if cfg.reportAuthHeader != "" {
+		name, value, _ := strings.Cut(cfg.reportAuthHeader, ":")
+		req.Header.Set(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send report: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("report rejected with %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+)
+
+// runReset deletes the stored version information from every Redis target:
+// the -hash and -serial-hash hashes, or in -redis-key-mode keys their
+// name:field string keys. Each deleted key is logged; with -dry-run the
+// existing keys are only logged. The returned exit code is exitFailure if any
+// delete failed.
+func runReset(ctx context.Context, cfg *config) int {
+	// A reset that skipped an unreachable target would leave stale data
+	cfg.redisRequireAll = true
+	conns, err := connectRedisTargets(ctx, cfg)
+	if err != nil {
+		fatal("Failed to connect to Redis", "redis_addr", cfg.redisTarget(), "error", err)
+	}
+	defer closeRedisTargets(conns)
+
+	names := []string{cfg.hashName}
+	if cfg.redisKeyMode == "keys" {
+		names[0] = cfg.redisKeyPrefix
+	}
+	if cfg.serialHash != "" {
+		names = append(names, cfg.serialHash)
+	}
+
+	code := 0
+	for _, conn := range conns {
+		deleted := 0
+		for _, name := range names {
+			n, err := resetKeys(ctx, conn, cfg, name)
+			deleted += n
+			if err != nil {
+				slog.Error("Failed to delete Redis keys", "key", name, "redis_addr", conn.addr, "error", err)
+				code = exitFailure
+			}
+		}
+		if cfg.dryRun {
+			slog.Info("Dry run: version information not reset", "redis_addr", conn.addr, "would_delete", deleted)
+			continue
+		}
+		slog.Info("Reset version information", "redis_addr", conn.addr, "deleted", deleted)
+	}
+	return code
+}
+
+// resetKeys deletes the hash name, or in -redis-key-mode keys the name:field
+// keys, and returns how many keys were deleted. With -dry-run it returns how
+// many would be.
+func resetKeys(ctx context.Context, conn redisConn, cfg *config, name string) (int, error) {
+	keys := []string{name}
+	if cfg.redisKeyMode == "keys" {
+		var err error
+		if keys, err = scanFieldKeys(ctx, conn.rdb, name); err != nil {
+			return 0, err
+		}
+	}
+
+	deleted := 0
+	for _, key := range keys {
+		if cfg.dryRun {
+			n, err := conn.rdb.Exists(ctx, key).Result()
+			if err != nil {
+				return deleted, err
+			}
+			if n > 0 {
+				slog.Info("Dry run: would delete Redis key", "key", key, "redis_addr", conn.addr)
+				deleted++
+			}
+			continue
+		}
+		// One DEL per key, so the log names exactly what existed; a
+		// multi-key DEL would also fail across Cluster slots
+		n, err := conn.rdb.Del(ctx, key).Result()
+		if err != nil {
+			return deleted, err
+		}
+		if n == 0 {
+			slog.Debug("Redis key not present", "key", key, "redis_addr", conn.addr)
+			continue
+		}
+		slog.Info("Deleted Redis key", "key", key, "redis_addr", conn.addr)
+		deleted++
+	}
+	return deleted, nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/librescoot/version-service/pkg/versioninfo"
+)
+
+// selftestCheck is one capability probed by -selftest. run returns a short
+// detail on success; errSkipped marks a check that does not apply.
+type selftestCheck struct {
+	name string
+	run  func() (string, error)
+}
+
+// errSkipped is returned by a selftest check that is disabled by the
+// configuration.
+var errSkipped = errors.New("skipped")
+
+// runSelftest probes each read path and Redis without writing anything,
+// prints PASS, FAIL or SKIP per capability and returns the exit code: 0 if
+// nothing failed, exitFailure otherwise.
+func runSelftest(ctx context.Context, cfg *config) int {
+	layout := cfg.layout
+	checks := []selftestCheck{
+		{"os_release", func() (string, error) {
+			data, path, err := loadOSRelease(cfg.osReleasePath, cfg.osReleaseOptions())
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("%d keys from %s", data.size(), path), nil
+		}},
+		{"nvmem", func() (string, error) {
+			if cfg.noSerial {
+				return "", errSkipped
+			}
+			if _, err := os.Stat(layout.NVMEMPath); err != nil {
+				return "", err
+			}
+			cfg0Hex, _, err := versioninfo.ReadNVMEMWord(layout, layout.CFG0Offset)
+			if err != nil {
+				return "", err
+			}
+			cfg1Hex, _, err := versioninfo.ReadNVMEMWord(layout, layout.CFG1Offset)
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("%s cfg0=%s cfg1=%s", layout.NVMEMPath, cfg0Hex, cfg1Hex), nil
+		}},
+		{"otp", func() (string, error) {
+			if layout.NoOTP || cfg.noSerial {
+				return "", errSkipped
+			}
+			for _, path := range []string{layout.OTPCFG0Path, layout.OTPCFG1Path} {
+				if _, err := versioninfo.ReadFileTimeout(path, layout.ReadTimeout); err != nil {
+					return "", err
+				}
+			}
+			return fmt.Sprintf("%s, %s", layout.OTPCFG0Path, layout.OTPCFG1Path), nil
+		}},
+		{"eeprom", func() (string, error) {
+			if layout.EEPROMPath == "" || cfg.noSerial {
+				return "", errSkipped
+			}
+			serial, err := versioninfo.ReadEEPROMSerial(layout.EEPROMPath, layout.EEPROMOffset, layout.EEPROMLength, layout.ReadTimeout)
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("%s offset %d id=%s", layout.EEPROMPath, layout.EEPROMOffset, serial), nil
+		}},
+		{"serial", func() (string, error) {
+			if cfg.noSerial {
+				return "", errSkipped
+			}
+			// Bypass the cache so the fuses themselves are exercised
+			reader := &versioninfo.OCOTPReader{Layout: layout, AllowZero: cfg.allowZeroSerial}
+			res := &collectResult{}
+			collectIdentity(cfg, reader, res)
+			if res.serialErr != nil {
+				return "", res.serialErr
+			}
+			serialReal, _ := res.serial.get("serial_number_real")
+			return "serial_number_real=" + serialReal, nil
+		}},
+		{"redis", func() (string, error) {
+			if !cfg.writesRedis() {
+				return "", errSkipped
+			}
+			cfg.redisRequireAll = true
+			conns, err := connectRedisTargets(ctx, cfg)
+			if err != nil {
+				return "", err
+			}
+			closeRedisTargets(conns)
+			return cfg.redisTarget(), nil
+		}},
+	}
+
+	code := 0
+	for _, check := range checks {
+		detail, err := check.run()
+		switch {
+		case errors.Is(err, errSkipped):
+			fmt.Printf("SKIP %s\n", check.name)
+		case err != nil:
+			fmt.Printf("FAIL %s: %v\n", check.name, err)
+			code = exitFailure
+		default:
+			fmt.Printf("PASS %s: %s\n", check.name, detail)
+		}
+	}
+	return code
+}
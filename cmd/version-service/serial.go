@@ -0,0 +1,22 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/librescoot/version-service/pkg/versioninfo"
+)
+
+// serialHexCase converts a hex serial field to the -serial-hex-case letter
+// case. Values are read in lowercase, so only "upper" changes anything.
+func serialHexCase(letterCase, hexStr string) string {
+	if letterCase == "upper" {
+		return strings.ToUpper(hexStr)
+	}
+	return hexStr
+}
+
+// serialChecksums maps -verify-serial-checksum values to validators run over
+// serial_number_real.
+var serialChecksums = map[string]func(string) bool{
+	"luhn16": versioninfo.LuhnMod16Valid,
+}
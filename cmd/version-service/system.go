@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultKernelReleasePath = "/proc/sys/kernel/osrelease"
+	defaultUptimePath        = "/proc/uptime"
+)
+
+// readKernelRelease returns the running kernel release, as uname -r prints
+// it, from path.
+func readKernelRelease(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// readUptime returns the whole seconds since boot from the first field of
+// /proc/uptime at path.
+func readUptime(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("%s is empty", path)
+	}
+	seconds, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return "", fmt.Errorf("malformed uptime in %s: %w", path, err)
+	}
+	return strconv.FormatInt(int64(seconds), 10), nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// valueTransforms maps the -field-transform names to their functions.
+var valueTransforms = map[string]func(string) string{
+	"trim":  strings.TrimSpace,
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+}
+
+// parseFieldTransforms parses -field-transform entries of the form
+// key=transform[+transform...], separated by commas, into the transforms to
+// apply per lowercase os-release key.
+func parseFieldTransforms(s string) (map[string][]func(string) string, error) {
+	transforms := make(map[string][]func(string) string)
+	for _, entry := range splitList(s) {
+		key, names, ok := strings.Cut(entry, "=")
+		key = strings.ToLower(strings.TrimSpace(key))
+		if !ok || key == "" {
+			return nil, fmt.Errorf("%q: expected key=transform", entry)
+		}
+		for _, name := range strings.Split(names, "+") {
+			fn, ok := valueTransforms[strings.TrimSpace(name)]
+			if !ok {
+				return nil, fmt.Errorf("%q: unknown transform %q (must be trim, lower or upper)", entry, name)
+			}
+			transforms[key] = append(transforms[key], fn)
+		}
+	}
+	return transforms, nil
+}
+
+// parseFieldRenames parses -hash-field-rename entries of the form
+// key=newkey, separated by commas, into a map of lowercase os-release keys to
+// field names. Two keys may not be renamed to the same field.
+func parseFieldRenames(s string) (map[string]string, error) {
+	renames := make(map[string]string)
+	sources := make(map[string]string)
+	for _, entry := range splitList(s) {
+		key, newKey, ok := strings.Cut(entry, "=")
+		key = strings.ToLower(strings.TrimSpace(key))
+		newKey = strings.TrimSpace(newKey)
+		if !ok || key == "" || newKey == "" {
+			return nil, fmt.Errorf("%q: expected key=newkey", entry)
+		}
+		if _, dup := renames[key]; dup {
+			return nil, fmt.Errorf("%q renamed twice", key)
+		}
+		if other, dup := sources[newKey]; dup {
+			return nil, fmt.Errorf("%q and %q both renamed to %q", other, key, newKey)
+		}
+		renames[key] = newKey
+		sources[newKey] = key
+	}
+	return renames, nil
+}
+
+// applyTransforms runs value through transforms in order.
+func applyTransforms(transforms []func(string) string, value string) string {
+	for _, fn := range transforms {
+		value = fn(value)
+	}
+	return value
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"time"
+
+	"github.com/librescoot/version-service/pkg/versioninfo"
+)
+
+const (
+	// osReleaseDebounce is how long -watch waits for further events before
+	// refreshing, since an update usually writes and renames in quick
+	// succession.
+	osReleaseDebounce = 500 * time.Millisecond
+
+	// watchFallbackInterval is the polling interval of -watch when the
+	// file cannot be watched and -interval is not set.
+	watchFallbackInterval = time.Minute
+)
+
+// watchOSRelease returns a channel that receives a value once the os-release
+// file at path has changed and no further change followed within
+// osReleaseDebounce. Symlinks are resolved so a swap of the link target is
+// noticed too, and for the default path the /usr/lib fallback is watched as
+// well.
+func watchOSRelease(ctx context.Context, path string) (<-chan struct{}, error) {
+	paths := []string{path}
+	if resolved, err := filepath.EvalSymlinks(path); err == nil && resolved != path {
+		paths = append(paths, resolved)
+	}
+	if path == versioninfo.DefaultOSReleasePath {
+		paths = append(paths, versioninfo.FallbackOSReleasePath)
+	}
+
+	events, err := watchFiles(ctx, paths)
+	if err != nil {
+		return nil, err
+	}
+
+	changed := make(chan struct{}, 1)
+	go debounce(ctx, events, changed, osReleaseDebounce)
+	return changed, nil
+}
+
+// debounce signals out once no value has arrived on in for delay. A pending
+// signal that was not consumed yet is not duplicated.
+func debounce(ctx context.Context, in <-chan struct{}, out chan<- struct{}, delay time.Duration) {
+	timer := time.NewTimer(delay)
+	timer.Stop()
+	defer timer.Stop()
+
+	for {
+		select {
+		case _, ok := <-in:
+			if !ok {
+				return
+			}
+			timer.Reset(delay)
+		case <-timer.C:
+			select {
+			case out <- struct{}{}:
+			default:
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+// inotifyMask selects the events that replace or rewrite a file in a watched
+// directory.
+const inotifyMask = syscall.IN_MODIFY | syscall.IN_CLOSE_WRITE | syscall.IN_CREATE |
+	syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO
+
+// watchFiles watches the directories holding paths with inotify and sends on
+// the returned channel for every event on one of the files. Directories
+// rather than files are watched so that replacing a file by rename, as
+// updates do, keeps being noticed. The channel is closed when ctx is done or
+// reading the events fails.
+func watchFiles(ctx context.Context, paths []string) (<-chan struct{}, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("inotify_init1: %w", err)
+	}
+	// A non-blocking descriptor makes the file pollable, so Close unblocks
+	// a pending Read
+	file := os.NewFile(uintptr(fd), "inotify")
+
+	// names maps each watch descriptor to the file names of interest in
+	// that directory
+	names := make(map[int32]map[string]bool)
+	for _, path := range paths {
+		dir, name := filepath.Split(filepath.Clean(path))
+		if dir == "" {
+			dir = "."
+		}
+		wd, err := syscall.InotifyAddWatch(fd, dir, inotifyMask)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to watch %s: %w", dir, err)
+		}
+		if names[int32(wd)] == nil {
+			names[int32(wd)] = make(map[string]bool)
+		}
+		names[int32(wd)][name] = true
+	}
+
+	go func() {
+		<-ctx.Done()
+		file.Close()
+	}()
+
+	events := make(chan struct{}, 1)
+	go func() {
+		defer close(events)
+		buf := make([]byte, 4096)
+		for {
+			n, err := file.Read(buf)
+			if err != nil {
+				if ctx.Err() == nil {
+					slog.Warn("Stopped watching os-release", "error", err)
+				}
+				return
+			}
+
+			for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+				event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+				nameStart := offset + syscall.SizeofInotifyEvent
+				nameEnd := nameStart + int(event.Len)
+				if nameEnd > n {
+					break
+				}
+				name := string(buf[nameStart:nameEnd])
+				for len(name) > 0 && name[len(name)-1] == 0 {
+					name = name[:len(name)-1]
+				}
+				offset = nameEnd
+
+				if names[event.Wd][name] {
+					slog.Debug("os-release watch event", "name", name, "mask", fmt.Sprintf("%#x", event.Mask))
+					select {
+					case events <- struct{}{}:
+					default:
+					}
+				}
+			}
+		}
+	}()
+
+	return events, nil
+}
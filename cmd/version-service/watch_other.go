@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+// watchFiles is only implemented with inotify on Linux.
+func watchFiles(ctx context.Context, paths []string) (<-chan struct{}, error) {
+	return nil, errors.New("file watching is not supported on this platform")
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// plainYAMLKey matches keys that need no quoting in YAML.
+var plainYAMLKey = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]*$`)
+
+// writeYAML writes the build version, identifier source, os-release data and
+// serial fields of res to w as a YAML document with sorted keys. Values are
+// always double-quoted so that version strings like 1.10 or yes stay
+// strings.
+func writeYAML(w io.Writer, res *collectResult) error {
+	var b strings.Builder
+	b.WriteString("---\n")
+	fmt.Fprintf(&b, "version: %s\n", strconv.Quote(version))
+	fmt.Fprintf(&b, "identifier_source: %s\n", strconv.Quote(res.identifierSource))
+	writeYAMLMap(&b, "os_release", res.osRelease)
+	writeYAMLMap(&b, "serial", res.serial)
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// writeYAMLMap writes fields as a block mapping under name, or an empty flow
+// mapping if there are none.
+func writeYAMLMap(b *strings.Builder, name string, fields *fieldSet) {
+	if fields == nil || fields.size() == 0 {
+		fmt.Fprintf(b, "%s: {}\n", name)
+		return
+	}
+	keys := make([]string, 0, fields.size())
+	fields.each(func(key, _ string) {
+		keys = append(keys, key)
+	})
+	sort.Strings(keys)
+
+	fmt.Fprintf(b, "%s:\n", name)
+	for _, key := range keys {
+		value, _ := fields.get(key)
+		if !plainYAMLKey.MatchString(key) {
+			key = strconv.Quote(key)
+		}
+		fmt.Fprintf(b, "  %s: %s\n", key, strconv.Quote(value))
+	}
+}
@@ -0,0 +1,595 @@
+package versioninfo
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// IdentifierReader provides the two halves of the device unique ID. Either
+// half may be empty when that part could not be read, in which case err
+// describes why.
+type IdentifierReader interface {
+	ReadIdentifiers() (Identifiers, error)
+}
+
+// Identifier sources reported in Identifiers.
+const (
+	SourceNVMEM  = "nvmem"
+	SourceOTP    = "otp"
+	SourceCache  = "cache"
+	SourceDT     = "devicetree"
+	SourceEEPROM = "eeprom"
+)
+
+// DefaultDTSerialPath is where the kernel exposes the devicetree
+// serial-number property.
+const DefaultDTSerialPath = "/proc/device-tree/serial-number"
+
+// Identifiers holds the two halves of the device unique ID as hex strings,
+// together with the source each half was read from.
+type Identifiers struct {
+	CFG0       string
+	CFG1       string
+	CFG0Source string
+	CFG1Source string
+	// CFG0Raw and CFG1Raw are the 4 bytes of each half exactly as read
+	// from NVMEM, before any byte order is applied; nil for a half read
+	// from another source.
+	CFG0Raw []byte
+	CFG1Raw []byte
+	// DTSerial is the devicetree serial number when it was read as a
+	// fallback but could not be split into CFG0 and CFG1.
+	DTSerial string
+}
+
+// ErrNotProvisioned is returned with the identifiers when both halves read
+// back as zero, which is what unfused boards report.
+var ErrNotProvisioned = errors.New("CFG0 and CFG1 are all zero, OCOTP fuses not provisioned")
+
+// ErrNVMEMNotFound is the NVMEM source error when the device does not exist.
+var ErrNVMEMNotFound = errors.New("not found")
+
+// IdentifierError reports the identifier parts that could not be read from
+// any source.
+type IdentifierError struct {
+	Parts []*PartError
+}
+
+func (e *IdentifierError) Error() string {
+	msgs := make([]string, len(e.Parts))
+	for i, part := range e.Parts {
+		msgs[i] = part.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Unwrap returns the part errors, so errors.Is and errors.As see through to
+// the individual source failures.
+func (e *IdentifierError) Unwrap() []error {
+	errs := make([]error, len(e.Parts))
+	for i, part := range e.Parts {
+		errs[i] = part
+	}
+	return errs
+}
+
+// Failed reports whether part, "CFG0" or "CFG1", could not be read.
+func (e *IdentifierError) Failed(part string) bool {
+	for _, p := range e.Parts {
+		if p.Part == part {
+			return true
+		}
+	}
+	return false
+}
+
+// PartError is one identifier part that could not be read, with the failure
+// from every source tried, in order.
+type PartError struct {
+	Part    string
+	Sources []*SourceError
+}
+
+// add records a failed read from source at location.
+func (e *PartError) add(source, location string, err error) {
+	e.Sources = append(e.Sources, &SourceError{Source: source, Location: location, Err: err})
+}
+
+func (e *PartError) Error() string {
+	msgs := make([]string, len(e.Sources))
+	for i, src := range e.Sources {
+		msgs[i] = src.Error()
+	}
+	return fmt.Sprintf("%s_read_failed: {%s}", e.Part, strings.Join(msgs, ", "))
+}
+
+func (e *PartError) Unwrap() []error {
+	errs := make([]error, len(e.Sources))
+	for i, src := range e.Sources {
+		errs[i] = src
+	}
+	return errs
+}
+
+// SourceError is a failed read of an identifier part from one source
+// (SourceNVMEM, SourceOTP, SourceEEPROM or SourceDT). Location is the NVMEM offset or the
+// file path, empty if the source was not found at all.
+type SourceError struct {
+	Source   string
+	Location string
+	Err      error
+}
+
+// sourceLabels are the names used for each source in error messages.
+var sourceLabels = map[string]string{
+	SourceNVMEM:  "NVMEM",
+	SourceOTP:    "OTP",
+	SourceDT:     "devicetree",
+	SourceEEPROM: "EEPROM",
+}
+
+func (e *SourceError) Error() string {
+	label := sourceLabels[e.Source]
+	if e.Location == "" {
+		return label + ": " + e.Err.Error()
+	}
+	return fmt.Sprintf("%s(%s): %s", label, e.Location, e.Err.Error())
+}
+
+func (e *SourceError) Unwrap() error {
+	return e.Err
+}
+
+// Source summarises where the identifiers came from: the common source of
+// both halves, both sources joined with "+" if they differ, or "none".
+func (ids Identifiers) Source() string {
+	switch {
+	case ids.CFG0Source == "" && ids.CFG1Source == "":
+		return "none"
+	case ids.CFG0Source == ids.CFG1Source:
+		return ids.CFG0Source
+	case ids.CFG0Source == "":
+		return ids.CFG1Source
+	case ids.CFG1Source == "":
+		return ids.CFG0Source
+	default:
+		return ids.CFG0Source + "+" + ids.CFG1Source
+	}
+}
+
+// OCOTPReader reads the unique ID from the i.MX OCOTP fuses, preferring the
+// NVMEM device and falling back to the OTP sysfs files and, if enabled, an
+// EEPROM and the devicetree serial number.
+type OCOTPReader struct {
+	Layout Layout
+	// AllowZero accepts an all-zero ID instead of reporting ErrNotProvisioned.
+	AllowZero bool
+	// WaitForNVMEM is how long to wait for the NVMEM device to appear
+	// before falling back to OTP.
+	WaitForNVMEM time.Duration
+}
+
+// ReadIdentifiers implements IdentifierReader.
+func (r *OCOTPReader) ReadIdentifiers() (Identifiers, error) {
+	if r.WaitForNVMEM > 0 && !waitForPath(r.Layout.NVMEMPath, r.WaitForNVMEM) {
+		slog.Warn("NVMEM device did not appear in time", "path", r.Layout.NVMEMPath, "waited", r.WaitForNVMEM.String())
+	}
+
+	ids, err := ReadIdentifierHexStrings(r.Layout)
+	if r.AllowZero && errors.Is(err, ErrNotProvisioned) {
+		err = nil
+	}
+	return ids, err
+}
+
+// Layout describes where a SoC exposes the two halves of its unique ID.
+type Layout struct {
+	NVMEMPath   string
+	CFG0Offset  int
+	CFG1Offset  int
+	OTPCFG0Path string
+	OTPCFG1Path string
+	// BigEndian selects big-endian interpretation of the NVMEM words.
+	BigEndian bool
+	// RejectValues are NVMEM words, as 8 lowercase hex digits, that a
+	// marginal read of a flaky fuse controller returns. Such a word is
+	// re-read up to Retries times before falling back to OTP.
+	RejectValues []string
+	Retries      int
+	// NoOTP disables the fallback to the OTP sysfs files.
+	NoOTP bool
+	// DTSerialPath is the devicetree serial-number property used as the
+	// last fallback; empty disables it.
+	DTSerialPath string
+	// EEPROMPath is an EEPROM holding the ID in EEPROMLength bytes at
+	// EEPROMOffset; empty disables it. It is read before the fuses if
+	// EEPROMPrimary is set and after OTP otherwise.
+	EEPROMPath    string
+	EEPROMOffset  int
+	EEPROMLength  int
+	EEPROMPrimary bool
+	// ReadTimeout bounds each fuse read; zero means no limit.
+	ReadTimeout time.Duration
+}
+
+// SoCLayouts maps the supported SoCs to their OCOTP layout. The i.MX8M family keeps
+// the unique ID in fuse words 1 and 2 like the i.MX6, but the vendor fsl_otp
+// driver names those registers TESTER0/TESTER1 instead of CFG0/CFG1.
+var SoCLayouts = map[string]Layout{
+	"imx6": {
+		NVMEMPath:   "/sys/bus/nvmem/devices/imx-ocotp0/nvmem",
+		CFG0Offset:  4,
+		CFG1Offset:  8,
+		OTPCFG0Path: "/sys/fsl_otp/HW_OCOTP_CFG0",
+		OTPCFG1Path: "/sys/fsl_otp/HW_OCOTP_CFG1",
+	},
+	"imx8mm": {
+		NVMEMPath:   "/sys/bus/nvmem/devices/imx-ocotp0/nvmem",
+		CFG0Offset:  4,
+		CFG1Offset:  8,
+		OTPCFG0Path: "/sys/fsl_otp/HW_OCOTP_TESTER0",
+		OTPCFG1Path: "/sys/fsl_otp/HW_OCOTP_TESTER1",
+	},
+}
+
+// ReadIdentifierHexStrings attempts to read raw hex strings for CFG0 and CFG1.
+// It prioritizes NVMEM, then falls back to OTP sysfs files unless layout.NoOTP is set,
+// then to the EEPROM if layout.EEPROMPath is set and to the devicetree serial number
+// if layout.DTSerialPath is set. With layout.EEPROMPrimary the EEPROM is tried first.
+// Returns the hex strings (which may be empty if a part is unreadable) with their sources, and an *IdentifierError if any part could not be read from any source.
+// If both parts read as zero the strings are returned together with ErrNotProvisioned.
+func ReadIdentifierHexStrings(layout Layout) (ids Identifiers, err error) {
+	var cfg0Hex, cfg1Hex string
+	nvmemDevicePath := layout.NVMEMPath
+	otpCfg0Path := layout.OTPCFG0Path
+	otpCfg1Path := layout.OTPCFG1Path
+
+	cfg0Err := &PartError{Part: "CFG0"}
+	cfg1Err := &PartError{Part: "CFG1"}
+
+	// readEEPROM fills whichever parts are still missing from the EEPROM
+	readEEPROM := func() {
+		serial, eepromErr := ReadEEPROMSerial(layout.EEPROMPath, layout.EEPROMOffset, layout.EEPROMLength, layout.ReadTimeout)
+		eepromCfg0, eepromCfg1, _ := splitDTSerial(serial)
+		location := fmt.Sprintf("%s offset %d", layout.EEPROMPath, layout.EEPROMOffset)
+		if cfg0Hex == "" {
+			if eepromErr == nil {
+				cfg0Hex, ids.CFG0Source, cfg0Err.Sources = eepromCfg0, SourceEEPROM, nil
+			} else {
+				cfg0Err.add(SourceEEPROM, location, eepromErr)
+			}
+		}
+		if cfg1Hex == "" {
+			if eepromErr == nil {
+				cfg1Hex, ids.CFG1Source, cfg1Err.Sources = eepromCfg1, SourceEEPROM, nil
+			} else {
+				cfg1Err.add(SourceEEPROM, location, eepromErr)
+			}
+		}
+	}
+	if layout.EEPROMPath != "" && layout.EEPROMPrimary {
+		readEEPROM()
+	}
+
+	nvmemPresent := false
+	if _, statErr := os.Stat(nvmemDevicePath); statErr == nil {
+		nvmemPresent = true
+	}
+
+	// --- Read CFG0 (Unique ID Part L) ---
+	if cfg0Hex == "" && nvmemPresent {
+		val, raw, nvmemErr := ReadNVMEMWord(layout, layout.CFG0Offset)
+		if nvmemErr == nil {
+			cfg0Hex, ids.CFG0Raw = val, raw
+			ids.CFG0Source = SourceNVMEM
+		} else {
+			cfg0Err.add(SourceNVMEM, fmt.Sprintf("offset %d", layout.CFG0Offset), nvmemErr)
+		}
+	} else if cfg0Hex == "" {
+		cfg0Err.add(SourceNVMEM, "", ErrNVMEMNotFound)
+	}
+
+	if cfg0Hex == "" && !layout.NoOTP {
+		data, otpErr := readOTPFile(otpCfg0Path, layout.ReadTimeout)
+		if otpErr == nil {
+			content := strings.TrimSpace(string(data))
+			cfg0Hex = strings.TrimPrefix(strings.ToLower(content), "0x")
+			ids.CFG0Source = SourceOTP
+			cfg0Err.Sources = nil
+		} else {
+			cfg0Err.add(SourceOTP, otpCfg0Path, otpErr)
+		}
+	}
+
+	// --- Read CFG1 (Unique ID Part H) ---
+	if cfg1Hex == "" && nvmemPresent {
+		val, raw, nvmemErr := ReadNVMEMWord(layout, layout.CFG1Offset)
+		if nvmemErr == nil {
+			cfg1Hex, ids.CFG1Raw = val, raw
+			ids.CFG1Source = SourceNVMEM
+		} else {
+			cfg1Err.add(SourceNVMEM, fmt.Sprintf("offset %d", layout.CFG1Offset), nvmemErr)
+		}
+	} else if cfg1Hex == "" {
+		cfg1Err.add(SourceNVMEM, "", ErrNVMEMNotFound)
+	}
+
+	if cfg1Hex == "" && !layout.NoOTP {
+		data, otpErr := readOTPFile(otpCfg1Path, layout.ReadTimeout)
+		if otpErr == nil {
+			content := strings.TrimSpace(string(data))
+			cfg1Hex = strings.TrimPrefix(strings.ToLower(content), "0x")
+			ids.CFG1Source = SourceOTP
+			cfg1Err.Sources = nil
+		} else {
+			cfg1Err.add(SourceOTP, otpCfg1Path, otpErr)
+		}
+	}
+
+	// --- EEPROM and devicetree fallbacks for whichever part is still missing ---
+	if (cfg0Hex == "" || cfg1Hex == "") && layout.EEPROMPath != "" && !layout.EEPROMPrimary {
+		readEEPROM()
+	}
+
+	if (cfg0Hex == "" || cfg1Hex == "") && layout.DTSerialPath != "" {
+		raw, dtErr := readDTSerial(layout.DTSerialPath, layout.ReadTimeout)
+		dtCfg0, dtCfg1, ok := splitDTSerial(raw)
+		if dtErr == nil && !ok {
+			// Keep it anyway; an unsplittable serial still identifies the board
+			ids.DTSerial = raw
+			dtErr = fmt.Errorf("%q is not a 64-bit hex ID", raw)
+		}
+		if cfg0Hex == "" {
+			if ok {
+				cfg0Hex, ids.CFG0Source, cfg0Err.Sources = dtCfg0, SourceDT, nil
+			} else {
+				cfg0Err.add(SourceDT, layout.DTSerialPath, dtErr)
+			}
+		}
+		if cfg1Hex == "" {
+			if ok {
+				cfg1Hex, ids.CFG1Source, cfg1Err.Sources = dtCfg1, SourceDT, nil
+			} else {
+				cfg1Err.add(SourceDT, layout.DTSerialPath, dtErr)
+			}
+		}
+	}
+
+	var idErr IdentifierError
+	if cfg0Hex == "" && len(cfg0Err.Sources) > 0 {
+		idErr.Parts = append(idErr.Parts, cfg0Err)
+	}
+	if cfg1Hex == "" && len(cfg1Err.Sources) > 0 {
+		idErr.Parts = append(idErr.Parts, cfg1Err)
+	}
+
+	if len(idErr.Parts) > 0 {
+		err = &idErr
+	} else if isZeroHex(cfg0Hex) && isZeroHex(cfg1Hex) {
+		err = ErrNotProvisioned
+	}
+	ids.CFG0, ids.CFG1 = cfg0Hex, cfg1Hex
+	return
+}
+
+// waitForPath polls until path exists or timeout elapses, covering the
+// kernel probing the nvmem driver after the service has started. It reports
+// whether the path exists.
+func waitForPath(path string, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for attempt := 0; ; attempt++ {
+		if _, err := os.Stat(path); err == nil {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		if attempt == 0 {
+			slog.Debug("Waiting for NVMEM device", "path", path, "timeout", timeout.String())
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// isZeroHex reports whether hexStr consists only of zero digits.
+func isZeroHex(hexStr string) bool {
+	return hexStr != "" && strings.Trim(hexStr, "0") == ""
+}
+
+// ReadHexValueFromNVMEM reads a 4-byte hex value from the NVMEM device at a given offset.
+func ReadHexValueFromNVMEM(nvmemDevicePath string, offset int, bigEndian bool, timeout time.Duration) (string, error) {
+	buffer, err := ReadNVMEMBytes(nvmemDevicePath, offset, 4, timeout)
+	if err != nil {
+		return "", err
+	}
+	return formatFuseWord(buffer, bigEndian), nil
+}
+
+// nvmemRetryDelay is the pause before re-reading a rejected NVMEM word.
+const nvmemRetryDelay = 50 * time.Millisecond
+
+// ReadNVMEMWord reads the fuse word at offset of layout.NVMEMPath like
+// ReadHexValueFromNVMEM, re-reading it up to layout.Retries times while it is
+// one of layout.RejectValues. It returns the word as hex and the 4 bytes it
+// was decoded from, and fails if the word is still rejected after the
+// retries.
+func ReadNVMEMWord(layout Layout, offset int) (string, []byte, error) {
+	for attempt := 0; ; attempt++ {
+		raw, err := ReadNVMEMBytes(layout.NVMEMPath, offset, 4, layout.ReadTimeout)
+		if err != nil {
+			return "", nil, err
+		}
+		value := formatFuseWord(raw, layout.BigEndian)
+		if !slices.Contains(layout.RejectValues, value) {
+			return value, raw, nil
+		}
+		if attempt >= layout.Retries {
+			return "", nil, fmt.Errorf("rejected value %s read %d times", value, attempt+1)
+		}
+		slog.Debug("Re-reading rejected NVMEM word", "offset", offset, "value", value, "attempt", attempt+1)
+		time.Sleep(nvmemRetryDelay)
+	}
+}
+
+// ReadNVMEMBytes reads length bytes from the NVMEM device at offset, giving
+// up after timeout if it is not zero.
+func ReadNVMEMBytes(nvmemDevicePath string, offset, length int, timeout time.Duration) ([]byte, error) {
+	return readDeviceBytes("NVMEM device "+nvmemDevicePath, nvmemDevicePath, offset, length, timeout)
+}
+
+// readDeviceBytes reads length bytes at offset from the device file at path,
+// giving up after timeout if it is not zero. device names the source in
+// errors, e.g. "EEPROM /sys/bus/i2c/devices/0-0050/eeprom".
+func readDeviceBytes(device, path string, offset, length int, timeout time.Duration) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %v", device, err)
+	}
+	defer file.Close()
+
+	return withReadTimeout(file, timeout, func() ([]byte, error) {
+		return readDeviceRange(file, device, offset, length)
+	})
+}
+
+// readOTPFile reads an OTP sysfs file, logging its raw contents at debug
+// level before they are interpreted.
+func readOTPFile(path string, timeout time.Duration) ([]byte, error) {
+	data, err := ReadFileTimeout(path, timeout)
+	if err == nil {
+		slog.Debug("Read OTP file", "path", path, "bytes", len(data), "raw", hex.EncodeToString(data))
+	}
+	return data, err
+}
+
+// readDTSerial reads a devicetree string property, dropping the trailing NUL
+// and surrounding whitespace.
+func readDTSerial(path string, timeout time.Duration) (string, error) {
+	data, err := ReadFileTimeout(path, timeout)
+	if err != nil {
+		return "", err
+	}
+	slog.Debug("Read devicetree serial number", "path", path, "raw", hex.EncodeToString(data))
+	return strings.TrimSpace(strings.TrimRight(string(data), "\x00")), nil
+}
+
+// ReadEEPROMSerial reads length bytes at offset from an EEPROM, such as the
+// sysfs eeprom file of an I2C EEPROM, with the same seek and fixed-length read
+// as the NVMEM fuses. The bytes are taken as one big-endian number and
+// zero-extended to 16 hex digits, ready for splitDTSerial.
+func ReadEEPROMSerial(path string, offset, length int, timeout time.Duration) (string, error) {
+	buffer, err := readDeviceBytes("EEPROM "+path, path, offset, length, timeout)
+	if err != nil {
+		return "", err
+	}
+	digits := hex.EncodeToString(buffer)
+	return strings.Repeat("0", 16-len(digits)) + digits, nil
+}
+
+// splitDTSerial splits a devicetree serial number holding the 64-bit unique
+// ID as 16 hex digits, as the i.MX SoC driver and U-Boot write it, into the
+// CFG0 (low word) and CFG1 (high word) halves.
+func splitDTSerial(serial string) (cfg0Hex, cfg1Hex string, ok bool) {
+	serial = strings.TrimPrefix(strings.ToLower(serial), "0x")
+	if len(serial) != 16 {
+		return "", "", false
+	}
+	if _, err := hex.DecodeString(serial); err != nil {
+		return "", "", false
+	}
+	return serial[8:], serial[:8], true
+}
+
+// ReadFileTimeout reads the whole file at path, giving up after timeout if it
+// is not zero.
+func ReadFileTimeout(path string, timeout time.Duration) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return withReadTimeout(file, timeout, func() ([]byte, error) {
+		return io.ReadAll(file)
+	})
+}
+
+// withReadTimeout runs read on file, returning an error if it takes longer
+// than timeout so a hung fuse driver cannot block the service. On a timeout
+// file is closed, which ends the read as soon as the driver lets go of it.
+// A zero timeout runs read directly.
+func withReadTimeout(file *os.File, timeout time.Duration, read func() ([]byte, error)) ([]byte, error) {
+	if timeout <= 0 {
+		return read()
+	}
+	// Fd puts the file into blocking mode, so Close below returns at once
+	// instead of waiting for a read stuck in the driver
+	file.Fd()
+
+	type result struct {
+		data []byte
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		data, err := read()
+		done <- result{data, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.data, r.err
+	case <-time.After(timeout):
+		file.Close()
+		return nil, fmt.Errorf("read from %s timed out after %s", file.Name(), timeout)
+	}
+}
+
+// readDeviceRange does the actual read for readDeviceBytes.
+func readDeviceRange(file *os.File, device string, offset, length int) ([]byte, error) {
+	// Seeking past the end succeeds, so check the size up front to report
+	// a clear error. Some backends report size 0; rely on the read there.
+	if info, err := file.Stat(); err == nil && info.Size() > 0 && int64(offset+length) > info.Size() {
+		return nil, fmt.Errorf("%s is %d bytes, too small to read %d bytes at offset %d", device, info.Size(), length, offset)
+	}
+
+	return readRange(file, device, offset, length)
+}
+
+// readRange seeks r to offset and reads exactly length bytes from it. Read
+// may legitimately return fewer bytes than asked for, so it keeps reading
+// until all have arrived or r reports EOF. device names the source in
+// errors.
+func readRange(r io.ReadSeeker, device string, offset, length int) ([]byte, error) {
+	if _, err := r.Seek(int64(offset), io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to seek in %s to offset %d: %v", device, offset, err)
+	}
+
+	buffer := make([]byte, length)
+	n, err := io.ReadFull(r, buffer)
+	slog.Debug("Read device bytes", "device", device, "offset", offset, "bytes", n, "raw", hex.EncodeToString(buffer[:n]))
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("unexpected number of bytes read from %s at offset %d: got %d, expected %d", device, offset, n, length)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from %s at offset %d: %v", device, offset, err)
+	}
+
+	return buffer, nil
+}
+
+// formatFuseWord renders a 4-byte fuse word as 8 hex characters. The default
+// little-endian order matches `hexdump -e '1/4 "%08x"'` on the device.
+func formatFuseWord(word []byte, bigEndian bool) string {
+	if bigEndian {
+		return fmt.Sprintf("%02x%02x%02x%02x", word[0], word[1], word[2], word[3])
+	}
+	return fmt.Sprintf("%02x%02x%02x%02x", word[3], word[2], word[1], word[0])
+}
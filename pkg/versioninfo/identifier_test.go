@@ -0,0 +1,142 @@
+package versioninfo
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// oneByteReader returns at most one byte per Read, like a slow sysfs
+// backend.
+type oneByteReader struct {
+	*bytes.Reader
+}
+
+func (r oneByteReader) Read(p []byte) (int, error) {
+	if len(p) > 1 {
+		p = p[:1]
+	}
+	return r.Reader.Read(p)
+}
+
+func TestFormatFuseWord(t *testing.T) {
+	word := []byte{0x01, 0x02, 0x03, 0x04}
+	if got := formatFuseWord(word, false); got != "04030201" {
+		t.Errorf("little-endian: got %q, want 04030201", got)
+	}
+	if got := formatFuseWord(word, true); got != "01020304" {
+		t.Errorf("big-endian: got %q, want 01020304", got)
+	}
+	if got := formatFuseWord([]byte{0xde, 0xad, 0xbe, 0x0f}, false); got != "0fbeadde" {
+		t.Errorf("leading zero: got %q, want 0fbeadde", got)
+	}
+}
+
+func TestReadRangeOneByteAtATime(t *testing.T) {
+	device := []byte{0x00, 0x00, 0x00, 0x00, 0x78, 0x56, 0x34, 0x12, 0xf0, 0xde, 0xbc, 0x9a}
+	r := oneByteReader{bytes.NewReader(device)}
+
+	word, err := readRange(r, "NVMEM device test", 4, 4)
+	if err != nil {
+		t.Fatalf("readRange: %v", err)
+	}
+	if got := formatFuseWord(word, false); got != "12345678" {
+		t.Errorf("CFG0 = %q, want 12345678", got)
+	}
+
+	word, err = readRange(r, "NVMEM device test", 8, 4)
+	if err != nil {
+		t.Fatalf("readRange: %v", err)
+	}
+	if got := formatFuseWord(word, false); got != "9abcdef0" {
+		t.Errorf("CFG1 = %q, want 9abcdef0", got)
+	}
+}
+
+func TestReadRangeShort(t *testing.T) {
+	r := oneByteReader{bytes.NewReader([]byte{0, 0, 0, 0, 0x78, 0x56})}
+	_, err := readRange(r, "NVMEM device test", 4, 4)
+	if err == nil || !strings.Contains(err.Error(), "got 2, expected 4") {
+		t.Fatalf("got %v, want a short read error", err)
+	}
+}
+
+var _ io.ReadSeeker = oneByteReader{}
+
+func TestWithReadTimeoutClosesFile(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The writer stays open, so a read from r blocks like a hung driver
+	defer w.Close()
+
+	start := time.Now()
+	_, err = withReadTimeout(r, 20*time.Millisecond, func() ([]byte, error) {
+		return io.ReadAll(r)
+	})
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("got %v, want a timeout error", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("timeout returned after %s", elapsed)
+	}
+	if _, err := r.Read(make([]byte, 1)); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("file still open after the timeout: read returned %v", err)
+	}
+}
+
+func TestReadFileTimeout(t *testing.T) {
+	path := t.TempDir() + "/HW_OCOTP_CFG0"
+	if err := os.WriteFile(path, []byte("0x12345678\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ReadFileTimeout(path, time.Second)
+	if err != nil || string(data) != "0x12345678\n" {
+		t.Errorf("got %q, %v", data, err)
+	}
+}
+
+func TestReadIdentifierHexStringsRawWords(t *testing.T) {
+	nvmem := t.TempDir() + "/nvmem"
+	content := []byte{0, 0, 0, 0, 1, 2, 3, 4, 5, 6, 7, 8}
+	if err := os.WriteFile(nvmem, content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, bigEndian := range []bool{false, true} {
+		layout := Layout{NVMEMPath: nvmem, CFG0Offset: 4, CFG1Offset: 8, BigEndian: bigEndian, NoOTP: true}
+		ids, err := ReadIdentifierHexStrings(layout)
+		if err != nil {
+			t.Fatalf("big-endian %v: %v", bigEndian, err)
+		}
+		if !bytes.Equal(ids.CFG0Raw, content[4:8]) || !bytes.Equal(ids.CFG1Raw, content[8:12]) {
+			t.Errorf("big-endian %v: raw words % x and % x", bigEndian, ids.CFG0Raw, ids.CFG1Raw)
+		}
+		cfg0Val, _ := ParseFuseWord(ids.CFG0)
+		cfg1Val, _ := ParseFuseWord(ids.CFG1)
+		if got := RawSerial(ids.CFG0Raw, ids.CFG1Raw, cfg0Val, cfg1Val); got != "AQIDBAUGBwg=" {
+			t.Errorf("big-endian %v: RawSerial = %q, want AQIDBAUGBwg=", bigEndian, got)
+		}
+	}
+}
+
+func TestReadEEPROMSerialErrorsNameEEPROM(t *testing.T) {
+	path := t.TempDir() + "/eeprom"
+	if err := os.WriteFile(path, make([]byte, 16), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{path, path + ".missing"} {
+		_, err := ReadEEPROMSerial(path, 12, 8, 0)
+		if err == nil {
+			t.Fatalf("%s: read past the end accepted", path)
+		}
+		if !strings.Contains(err.Error(), "EEPROM "+path) || strings.Contains(err.Error(), "NVMEM") {
+			t.Errorf("%s: error %q does not name the EEPROM", path, err)
+		}
+	}
+}
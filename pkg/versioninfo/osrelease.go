@@ -0,0 +1,287 @@
+// Package versioninfo reads the os-release file and the i.MX device unique ID
+// and computes the serial numbers from it, as stored by version-service. It
+// lets other tools reuse exactly the same parsing and serial computation.
+package versioninfo
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// The os-release locations from os-release(5).
+const (
+	DefaultOSReleasePath  = "/etc/os-release"
+	FallbackOSReleasePath = "/usr/lib/os-release"
+)
+
+// Field is one os-release key with its unquoted value.
+type Field struct {
+	Key   string
+	Value string
+}
+
+// OSReleaseOptions controls how os-release is parsed.
+type OSReleaseOptions struct {
+	// PreserveCase keeps keys as written instead of lowercasing them.
+	PreserveCase bool
+	// MaxValueBytes is the longest value returned; longer values are
+	// truncated to it, or dropped with SkipOversized. Zero means no limit.
+	MaxValueBytes int
+	SkipOversized bool
+}
+
+// maxLineBytes is the longest os-release line read in full. It leaves room
+// for the key, quotes and escapes around a value of MaxValueBytes; anything
+// past it is discarded without being buffered.
+func (o OSReleaseOptions) maxLineBytes() int {
+	return 2*o.MaxValueBytes + 4096
+}
+
+// LoadOSRelease reads os-release from path. When path is the default
+// /etc/os-release and it does not exist, /usr/lib/os-release is tried as
+// described in os-release(5). It returns the path that was actually read.
+// Keys are lowercased unless opts.PreserveCase is set.
+func LoadOSRelease(path string, opts OSReleaseOptions) ([]Field, string, error) {
+	data, err := ReadOSRelease(path, opts)
+	if err == nil || path != DefaultOSReleasePath || !errors.Is(err, fs.ErrNotExist) {
+		return data, path, err
+	}
+
+	data, fallbackErr := ReadOSRelease(FallbackOSReleasePath, opts)
+	if fallbackErr != nil {
+		return nil, "", fmt.Errorf("%v; %w", err, fallbackErr)
+	}
+	return data, FallbackOSReleasePath, nil
+}
+
+// ReadOSRelease reads the os-release file at path and returns its keys, lowercased unless opts.PreserveCase is set, and values in file order
+func ReadOSRelease(path string, opts OSReleaseOptions) ([]Field, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer file.Close()
+
+	data, err := ParseOSRelease(file, opts)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", path, err)
+	}
+	return data, nil
+}
+
+// ParseOSRelease parses os-release content from r into keys and unquoted
+// values, preserving file order. Keys are lowercased unless opts.PreserveCase
+// is set, in which case keys differing only in case stay distinct. A repeated
+// key keeps its first position but takes the last value; the duplicate is
+// logged since it usually means image overlays were merged badly. Values
+// longer than opts.MaxValueBytes are truncated or skipped with a warning, so
+// a corrupted file cannot make the service buffer or store huge values.
+func ParseOSRelease(r io.Reader, opts OSReleaseOptions) ([]Field, error) {
+	var data []Field
+	index := make(map[string]int)
+	limiter := &lineLimiter{max: opts.maxLineBytes()}
+	scanner := bufio.NewScanner(r)
+	if opts.MaxValueBytes > 0 {
+		scanner.Buffer(make([]byte, 0, 4096), limiter.max+2)
+		scanner.Split(limiter.split)
+	} else {
+		scanner.Split(scanAnyLines)
+	}
+
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		key := strings.TrimSpace(parts[0])
+		if !opts.PreserveCase {
+			key = strings.ToLower(key)
+		}
+		value := unquoteOSReleaseValue(parts[1])
+		if opts.MaxValueBytes > 0 && (limiter.cut || len(value) > opts.MaxValueBytes) {
+			if opts.SkipOversized {
+				slog.Warn("Skipping oversized os-release value", "key", key, "max_bytes", opts.MaxValueBytes, "line", lineNo)
+				continue
+			}
+			slog.Warn("Truncating oversized os-release value", "key", key, "max_bytes", opts.MaxValueBytes, "line", lineNo)
+			value = truncateUTF8(value, opts.MaxValueBytes)
+		}
+		if i, ok := index[key]; ok {
+			slog.Warn("Duplicate key in os-release, using last value", "key", key, "previous", data[i].Value, "value", value, "line", lineNo)
+			data[i].Value = value
+			continue
+		}
+		index[key] = len(data)
+		data = append(data, Field{Key: key, Value: value})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// scanAnyLines is a bufio.SplitFunc like bufio.ScanLines that also accepts a
+// lone \r as a line break, so files written with CRLF or old Mac line endings
+// do not leave a trailing \r in values.
+func scanAnyLines(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	for i, c := range data {
+		switch c {
+		case '\n':
+			return i + 1, data[:i], nil
+		case '\r':
+			if i+1 < len(data) {
+				if data[i+1] == '\n' {
+					return i + 2, data[:i], nil
+				}
+				return i + 1, data[:i], nil
+			}
+			if atEOF {
+				return i + 1, data[:i], nil
+			}
+			// Need the next byte to tell CRLF from a lone CR.
+			return 0, nil, nil
+		}
+	}
+	if atEOF {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// lineLimiter wraps scanAnyLines to cut lines longer than max: the first max
+// bytes are returned as the line and the rest is discarded up to the next
+// line break, so the scanner never needs a buffer larger than max.
+type lineLimiter struct {
+	max int
+	// cut reports whether the last line returned was cut.
+	cut bool
+	// discarding is set while skipping the rest of a cut line.
+	discarding bool
+}
+
+func (l *lineLimiter) split(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	if l.discarding {
+		i := bytes.IndexAny(data, "\r\n")
+		if i < 0 {
+			return len(data), nil, nil
+		}
+		// Let scanAnyLines find the end of the line break, then drop
+		// the empty line it returns
+		advance, _, err = scanAnyLines(data[i:], atEOF)
+		if advance == 0 {
+			return i, nil, err
+		}
+		l.discarding = false
+		return i + advance, nil, err
+	}
+
+	advance, token, err = scanAnyLines(data, atEOF)
+	l.cut = false
+	if token == nil && len(data) >= l.max {
+		// No line break within max bytes
+		l.cut, l.discarding = true, true
+		return l.max, data[:l.max], nil
+	}
+	if len(token) > l.max {
+		l.cut = true
+		token = token[:l.max]
+	}
+	return advance, token, err
+}
+
+// truncateUTF8 shortens s to at most n bytes without splitting a UTF-8
+// sequence.
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// OSReleaseDigest returns the hex SHA-256 of all os-release entries as
+// sorted key=value lines with lowercase keys, so it changes with any value
+// but not with the line order of the file or OSReleaseOptions.PreserveCase.
+func OSReleaseDigest(data []Field) string {
+	lines := make([]string, 0, len(data))
+	for _, f := range data {
+		lines = append(lines, strings.ToLower(f.Key)+"="+f.Value+"\n")
+	}
+	sort.Strings(lines)
+
+	h := sha256.New()
+	for _, line := range lines {
+		io.WriteString(h, line)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// unquoteOSReleaseValue decodes a shell-style os-release value the way systemd
+// does: single-quoted text is literal, double-quoted text honours backslash
+// escapes of ", \, $ and `, and outside quotes a backslash escapes any
+// character. Quoted and unquoted segments may be concatenated.
+func unquoteOSReleaseValue(raw string) string {
+	var b strings.Builder
+	var quote rune
+	escaped := false
+
+	for _, r := range strings.TrimSpace(raw) {
+		switch {
+		case escaped:
+			if quote == '"' && !strings.ContainsRune("\"\\$`", r) {
+				b.WriteRune('\\')
+			}
+			b.WriteRune(r)
+			escaped = false
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				b.WriteRune(r)
+			}
+		case r == '\\':
+			escaped = true
+		case quote == '"':
+			if r == '"' {
+				quote = 0
+			} else {
+				b.WriteRune(r)
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		default:
+			b.WriteRune(r)
+		}
+	}
+
+	return b.String()
+}
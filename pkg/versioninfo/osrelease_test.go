@@ -0,0 +1,273 @@
+package versioninfo
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+)
+
+// recordHandler is a slog.Handler that keeps every record it handles.
+type recordHandler struct {
+	mu      sync.Mutex
+	records []slog.Record
+}
+
+func (h *recordHandler) Enabled(context.Context, slog.Level) bool { return true }
+func (h *recordHandler) WithAttrs([]slog.Attr) slog.Handler       { return h }
+func (h *recordHandler) WithGroup(string) slog.Handler            { return h }
+
+func (h *recordHandler) Handle(_ context.Context, r slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.records = append(h.records, r)
+	return nil
+}
+
+// captureLogs routes the default logger to a recordHandler for the rest of
+// the test.
+func captureLogs(t *testing.T) *recordHandler {
+	t.Helper()
+	h := &recordHandler{}
+	old := slog.Default()
+	slog.SetDefault(slog.New(h))
+	t.Cleanup(func() { slog.SetDefault(old) })
+	return h
+}
+
+// warnings returns the attributes of each warning with message msg.
+func (h *recordHandler) warnings(msg string) []map[string]string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var found []map[string]string
+	for _, r := range h.records {
+		if r.Level != slog.LevelWarn || r.Message != msg {
+			continue
+		}
+		attrs := make(map[string]string)
+		r.Attrs(func(a slog.Attr) bool {
+			attrs[a.Key] = a.Value.String()
+			return true
+		})
+		found = append(found, attrs)
+	}
+	return found
+}
+
+// parse runs ParseOSRelease over content and fails the test on error.
+func parse(t *testing.T, content string, opts OSReleaseOptions) []Field {
+	t.Helper()
+	fields, err := ParseOSRelease(strings.NewReader(content), opts)
+	if err != nil {
+		t.Fatalf("ParseOSRelease(%q): %v", content, err)
+	}
+	return fields
+}
+
+// value returns the value of key in fields.
+func value(fields []Field, key string) (string, bool) {
+	for _, f := range fields {
+		if f.Key == key {
+			return f.Value, true
+		}
+	}
+	return "", false
+}
+
+func TestParseOSReleaseUnquoting(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want string
+	}{
+		{"unquoted", `VALUE=1.2.3`, "1.2.3"},
+		{"double quoted", `VALUE="Libre Scoot"`, "Libre Scoot"},
+		{"single quoted", `VALUE='Libre Scoot'`, "Libre Scoot"},
+		{"escaped double quote", `VALUE="A \"quoted\" name"`, `A "quoted" name`},
+		{"escaped backslash", `VALUE="C:\\path"`, `C:\path`},
+		{"escaped dollar and backtick", "VALUE=\"\\$HOME \\`cmd\\`\"", "$HOME `cmd`"},
+		{"other escape kept in double quotes", `VALUE="a\nb"`, `a\nb`},
+		{"backslash literal in single quotes", `VALUE='a\"b'`, `a\"b`},
+		{"escape outside quotes", `VALUE=Libre\ Scoot`, "Libre Scoot"},
+		{"equals sign in value", `VALUE="key=value=more"`, "key=value=more"},
+		{"unquoted equals sign", `VALUE=a=b`, "a=b"},
+		{"concatenated segments", `VALUE="a b"'c d'e`, "a bc de"},
+		{"surrounding whitespace", `VALUE=  "x"  `, "x"},
+		{"empty", `VALUE=`, ""},
+		{"empty quotes", `VALUE=""`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := value(parse(t, tt.line+"\n", OSReleaseOptions{}), "value")
+			if !ok {
+				t.Fatalf("%s: key missing", tt.line)
+			}
+			if got != tt.want {
+				t.Errorf("%s: got %q, want %q", tt.line, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseOSReleaseDuplicateKey(t *testing.T) {
+	logs := captureLogs(t)
+	fields := parse(t, "NAME=first\nVERSION_ID=1.0\nNAME=second\n", OSReleaseOptions{})
+
+	if len(fields) != 2 || fields[0].Key != "name" || fields[0].Value != "second" {
+		t.Errorf("got %+v, want name=second in first position", fields)
+	}
+
+	warnings := logs.warnings("Duplicate key in os-release, using last value")
+	if len(warnings) != 1 {
+		t.Fatalf("got %d duplicate key warnings, want 1", len(warnings))
+	}
+	w := warnings[0]
+	if w["key"] != "name" || w["previous"] != "first" || w["value"] != "second" || w["line"] != "3" {
+		t.Errorf("warning attributes %v", w)
+	}
+}
+
+func TestOSReleaseDigestIgnoresOrder(t *testing.T) {
+	a := parse(t, "NAME=LibreScoot\nVERSION_ID=1.2.3\nBUILD_ID=20240101\n", OSReleaseOptions{})
+	b := parse(t, "BUILD_ID=20240101\nNAME=LibreScoot\nVERSION_ID=1.2.3\n", OSReleaseOptions{})
+	c := parse(t, "BUILD_ID=20240101\nNAME=LibreScoot\nVERSION_ID=1.2.4\n", OSReleaseOptions{})
+
+	if OSReleaseDigest(a) != OSReleaseDigest(b) {
+		t.Error("reordered os-release files have different digests")
+	}
+	if OSReleaseDigest(a) == OSReleaseDigest(c) {
+		t.Error("changed value did not change the digest")
+	}
+}
+
+func TestParseOSReleaseLineEndings(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"LF", "NAME=LibreScoot\nVERSION_ID=1.2\nID=librescoot\n"},
+		{"CRLF", "NAME=LibreScoot\r\nVERSION_ID=1.2\r\nID=librescoot\r\n"},
+		{"lone CR", "NAME=LibreScoot\rVERSION_ID=1.2\rID=librescoot\r"},
+		{"mixed", "NAME=LibreScoot\r\nVERSION_ID=1.2\rID=librescoot"},
+		{"blank CRLF lines", "\r\nNAME=LibreScoot\r\n\r\nVERSION_ID=1.2\r\r\nID=librescoot\r\n"},
+	}
+	want := []Field{{"name", "LibreScoot"}, {"version_id", "1.2"}, {"id", "librescoot"}}
+	for _, tt := range tests {
+		for _, opts := range []OSReleaseOptions{{}, {MaxValueBytes: 64}} {
+			for _, oneByte := range []bool{false, true} {
+				var r io.Reader = strings.NewReader(tt.content)
+				if oneByte {
+					// Puts a buffer boundary between every CR and the
+					// LF after it
+					r = iotest.OneByteReader(r)
+				}
+				fields, err := ParseOSRelease(r, opts)
+				if err != nil {
+					t.Fatalf("%s, one byte %v: %v", tt.name, oneByte, err)
+				}
+				if !slices.Equal(fields, want) {
+					t.Errorf("%s, one byte %v, max %d: got %+v, want %+v", tt.name, oneByte, opts.MaxValueBytes, fields, want)
+				}
+			}
+		}
+	}
+}
+
+// scanLimited splits content with a lineLimiter of max bytes and returns the
+// lines and whether each was cut.
+func scanLimited(t *testing.T, r io.Reader, max int) ([]string, []bool) {
+	t.Helper()
+	limiter := &lineLimiter{max: max}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, max+2), max+2)
+	scanner.Split(limiter.split)
+	var lines []string
+	var cut []bool
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+		cut = append(cut, limiter.cut)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	return lines, cut
+}
+
+func TestLineLimiterSplit(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		lines   []string
+		cut     []bool
+	}{
+		{"short lines", "A=1\nB=2\n", []string{"A=1", "B=2"}, []bool{false, false}},
+		{"break within buffer", "A=1234567\r\nB=2\n", []string{"A=123456", "B=2"}, []bool{true, false}},
+		{"no break within buffer", "A=0123456789abcdef\nB=2\n", []string{"A=012345", "B=2"}, []bool{true, false}},
+		{"oversized CRLF line", "A=0123456789abcdef\r\nB=2\r\n", []string{"A=012345", "B=2"}, []bool{true, false}},
+		{"oversized last line", "B=2\nA=0123456789abcdef", []string{"B=2", "A=012345"}, []bool{false, true}},
+	}
+	for _, tt := range tests {
+		for _, oneByte := range []bool{false, true} {
+			var r io.Reader = strings.NewReader(tt.content)
+			if oneByte {
+				r = iotest.OneByteReader(r)
+			}
+			lines, cut := scanLimited(t, r, 8)
+			if !slices.Equal(lines, tt.lines) || !slices.Equal(cut, tt.cut) {
+				t.Errorf("%s, one byte %v: got %q cut %v, want %q cut %v", tt.name, oneByte, lines, cut, tt.lines, tt.cut)
+			}
+		}
+	}
+}
+
+func TestParseOSReleaseOversized(t *testing.T) {
+	long := strings.Repeat("x", 10000)
+	content := "NAME=LibreScoot\nDESCRIPTION=\"" + long + "\"\nVERSION_ID=1.2\n"
+
+	t.Run("truncate", func(t *testing.T) {
+		logs := captureLogs(t)
+		fields := parse(t, content, OSReleaseOptions{MaxValueBytes: 16})
+		want := []Field{{"name", "LibreScoot"}, {"description", strings.Repeat("x", 16)}, {"version_id", "1.2"}}
+		if !slices.Equal(fields, want) {
+			t.Errorf("got %+v, want %+v", fields, want)
+		}
+		warnings := logs.warnings("Truncating oversized os-release value")
+		if len(warnings) != 1 || warnings[0]["key"] != "description" || warnings[0]["line"] != "2" {
+			t.Errorf("got warnings %v", warnings)
+		}
+	})
+
+	t.Run("skip", func(t *testing.T) {
+		logs := captureLogs(t)
+		fields := parse(t, content, OSReleaseOptions{MaxValueBytes: 16, SkipOversized: true})
+		want := []Field{{"name", "LibreScoot"}, {"version_id", "1.2"}}
+		if !slices.Equal(fields, want) {
+			t.Errorf("got %+v, want %+v", fields, want)
+		}
+		warnings := logs.warnings("Skipping oversized os-release value")
+		if len(warnings) != 1 || warnings[0]["key"] != "description" || warnings[0]["line"] != "2" {
+			t.Errorf("got warnings %v", warnings)
+		}
+	})
+}
+
+func TestParseOSReleaseKeyCase(t *testing.T) {
+	content := "NAME=LibreScoot\nVersion_Id=1.2\nname=other\n"
+
+	lower := parse(t, content, OSReleaseOptions{})
+	want := []Field{{"name", "other"}, {"version_id", "1.2"}}
+	if !slices.Equal(lower, want) {
+		t.Errorf("lowercase: got %+v, want %+v", lower, want)
+	}
+
+	preserved := parse(t, content, OSReleaseOptions{PreserveCase: true})
+	want = []Field{{"NAME", "LibreScoot"}, {"Version_Id", "1.2"}, {"name", "other"}}
+	if !slices.Equal(preserved, want) {
+		t.Errorf("preserved: got %+v, want %+v", preserved, want)
+	}
+}
@@ -0,0 +1,208 @@
+package versioninfo
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// LegacySerial computes the legacy serial_number from the two 32-bit unique
+// ID halves. "sum" is the historical cfg0+cfg1, which is not injective and so
+// can collide between boards; "concat-decimal" is the full 64-bit cfg1:cfg0
+// value. The caller picks the base it is written in. It returns false for
+// "disabled".
+func LegacySerial(mode string, cfg0Val, cfg1Val uint64) (uint64, bool) {
+	switch mode {
+	case "sum":
+		return cfg0Val + cfg1Val, true
+	case "concat-decimal":
+		return cfg1Val<<32 | cfg0Val, true
+	default:
+		return 0, false
+	}
+}
+
+// RealSerial builds serial_number_real from the CFG0/CFG1 hex strings. The
+// default "cfg1cfg0" puts the high word first so the result reads as the
+// 64-bit unique ID; "cfg0cfg1" puts the low word first.
+func RealSerial(order, cfg0Hex, cfg1Hex string) string {
+	if order == "cfg0cfg1" {
+		return cfg0Hex + cfg1Hex
+	}
+	return cfg1Hex + cfg0Hex
+}
+
+// RawSerial returns the 64-bit unique ID as base64 of its 8 bytes as they sit
+// in NVMEM: CFG0 then CFG1. cfg0Raw and cfg1Raw are the words as read from
+// NVMEM (Identifiers.CFG0Raw and CFG1Raw), so the result does not depend on
+// the byte order used to decode them. A half read from another source has no
+// raw word and is encoded from cfg0Val or cfg1Val least significant byte
+// first, the layout of the i.MX OCOTP NVMEM device. Consumers can decode it
+// without parsing hex or caring about the order and letter case of the hex
+// serial.
+func RawSerial(cfg0Raw, cfg1Raw []byte, cfg0Val, cfg1Val uint64) string {
+	raw := make([]byte, 0, 8)
+	raw = appendFuseWord(raw, cfg0Raw, cfg0Val)
+	raw = appendFuseWord(raw, cfg1Raw, cfg1Val)
+	return base64.StdEncoding.EncodeToString(raw)
+}
+
+// appendFuseWord appends word if it holds the 4 raw bytes, or else val least
+// significant byte first.
+func appendFuseWord(dst, word []byte, val uint64) []byte {
+	if len(word) == 4 {
+		return append(dst, word...)
+	}
+	return binary.LittleEndian.AppendUint32(dst, uint32(val))
+}
+
+// DisplaySerial renders serial through mask for serial_number_display: each X
+// in mask takes the next character of serial and everything else is copied
+// as is, so XXXX-XXXX-XXXX-XXXX groups a 16-digit serial in fours. mask must
+// have exactly one X per character of serial.
+func DisplaySerial(mask, serial string) (string, error) {
+	if n := strings.Count(mask, "X"); n != len(serial) {
+		return "", fmt.Errorf("%q has %d X placeholders for a %d-character serial", mask, n, len(serial))
+	}
+	var b strings.Builder
+	next := 0
+	for _, r := range mask {
+		if r == 'X' {
+			b.WriteByte(serial[next])
+			next++
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String(), nil
+}
+
+// FormatSerial expands the serial format directives in format. A directive
+// is %[0][width][.group]verb: verb d is the legacy serial in decimal, x and X
+// the 64-bit real serial in hex, z and Z the real serial in base 36. A 0 flag
+// pads to width with zeros instead of spaces, and group inserts a dash every
+// group characters. %% is a literal percent sign. hasLegacy is false when no
+// legacy serial is computed, which makes %d an error.
+func FormatSerial(format string, legacy uint64, hasLegacy bool, realVal uint64) (string, error) {
+	var out strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			out.WriteByte(format[i])
+			continue
+		}
+		i++
+		if i < len(format) && format[i] == '%' {
+			out.WriteByte('%')
+			continue
+		}
+
+		pad := " "
+		if i < len(format) && format[i] == '0' {
+			pad = "0"
+			i++
+		}
+		width := 0
+		for ; i < len(format) && format[i] >= '0' && format[i] <= '9'; i++ {
+			width = width*10 + int(format[i]-'0')
+		}
+		group := 0
+		if i < len(format) && format[i] == '.' {
+			for i++; i < len(format) && format[i] >= '0' && format[i] <= '9'; i++ {
+				group = group*10 + int(format[i]-'0')
+			}
+		}
+		if i >= len(format) {
+			return "", fmt.Errorf("%q: incomplete directive at end", format)
+		}
+
+		var s string
+		switch format[i] {
+		case 'd':
+			if !hasLegacy {
+				return "", fmt.Errorf("%q: %%d needs serial_number, which -legacy-serial-mode disabled", format)
+			}
+			s = strconv.FormatUint(legacy, 10)
+		case 'x':
+			s = strconv.FormatUint(realVal, 16)
+		case 'X':
+			s = strings.ToUpper(strconv.FormatUint(realVal, 16))
+		case 'z':
+			s = strconv.FormatUint(realVal, 36)
+		case 'Z':
+			s = strings.ToUpper(strconv.FormatUint(realVal, 36))
+		default:
+			return "", fmt.Errorf("%q: unknown verb %%%c (must be d, x, X, z or Z)", format, format[i])
+		}
+		if len(s) < width {
+			s = strings.Repeat(pad, width-len(s)) + s
+		}
+		out.WriteString(groupDigits(s, group))
+	}
+	return out.String(), nil
+}
+
+// groupDigits inserts a dash into s every n characters, counted from the
+// left. n of zero leaves s unchanged.
+func groupDigits(s string, n int) string {
+	if n <= 0 || len(s) <= n {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i += n {
+		if i > 0 {
+			b.WriteByte('-')
+		}
+		b.WriteString(s[i:min(i+n, len(s))])
+	}
+	return b.String()
+}
+
+// LuhnMod16Valid reports whether the hex string s carries a valid Luhn mod 16
+// check digit in its last position.
+func LuhnMod16Valid(s string) bool {
+	if s == "" {
+		return false
+	}
+	sum := 0
+	double := false
+	for i := len(s) - 1; i >= 0; i-- {
+		d, err := strconv.ParseUint(strings.ToLower(s[i:i+1]), 16, 8)
+		if err != nil {
+			return false
+		}
+		v := int(d)
+		if double {
+			v *= 2
+			v = v/16 + v%16
+		}
+		sum += v
+		double = !double
+	}
+	return sum%16 == 0
+}
+
+// ParseFuseWord parses one 32-bit fuse word given as exactly 8 hex characters,
+// optionally prefixed with "0x". Anything shorter or longer means the
+// identifier was read incorrectly, even if it would still parse.
+func ParseFuseWord(hexStr string) (uint64, error) {
+	digits := strings.TrimPrefix(strings.ToLower(hexStr), "0x")
+	if len(digits) != 8 {
+		return 0, fmt.Errorf("expected 8 hex characters, got %d", len(digits))
+	}
+	return ParseHexFromString(digits)
+}
+
+// ParseHexFromString parses a hexadecimal string, with or without a "0x" or "0X" prefix, into a uint64.
+func ParseHexFromString(hexStr string) (uint64, error) {
+	digits := hexStr
+	if len(digits) > 2 && digits[0] == '0' && (digits[1] == 'x' || digits[1] == 'X') {
+		digits = digits[2:]
+	}
+	value, err := strconv.ParseUint(digits, 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("cannot parse hex string '%s': %v", hexStr, err)
+	}
+	return value, nil
+}
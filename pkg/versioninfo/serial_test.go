@@ -0,0 +1,102 @@
+package versioninfo
+
+import "testing"
+
+func TestParseFuseWord(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    uint64
+		wantErr bool
+	}{
+		{"0a1b2c3d", 0x0a1b2c3d, false},
+		{"0A1B2C3D", 0x0a1b2c3d, false},
+		{"0x0a1b2c3d", 0x0a1b2c3d, false},
+		{"00000000", 0, false},
+		{"a1b2c3d", 0, true},
+		{"0a1b2c3d4", 0, true},
+		{"0x0a1b2c3", 0, true},
+		{"0a1b2c3g", 0, true},
+		{"zzzzzzzz", 0, true},
+		{"", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseFuseWord(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseFuseWord(%q) = %#x, want an error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("ParseFuseWord(%q) = %#x, %v, want %#x", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestRealSerial(t *testing.T) {
+	const cfg0, cfg1 = "89abcdef", "01234567"
+	if got := RealSerial("cfg1cfg0", cfg0, cfg1); got != "0123456789abcdef" {
+		t.Errorf("cfg1cfg0: got %q, want 0123456789abcdef", got)
+	}
+	if got := RealSerial("cfg0cfg1", cfg0, cfg1); got != "89abcdef01234567" {
+		t.Errorf("cfg0cfg1: got %q, want 89abcdef01234567", got)
+	}
+}
+
+func TestDisplaySerial(t *testing.T) {
+	tests := []struct {
+		mask, serial, want string
+		wantErr            bool
+	}{
+		{"XXXX-XXXX-XXXX-XXXX", "0123456789abcdef", "0123-4567-89ab-cdef", false},
+		{"SN XXXXXXXX/XXXXXXXX", "0123456789ABCDEF", "SN 01234567/89ABCDEF", false},
+		{"XXXX-XXXX-XXXX", "0123456789abcdef", "", true},
+		{"XXXX-XXXX-XXXX-XXXX-X", "0123456789abcdef", "", true},
+	}
+	for _, tt := range tests {
+		got, err := DisplaySerial(tt.mask, tt.serial)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("DisplaySerial(%q, %q) = %q, want an error", tt.mask, tt.serial, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("DisplaySerial(%q, %q) = %q, %v, want %q", tt.mask, tt.serial, got, err, tt.want)
+		}
+	}
+}
+
+func TestParseHexFromString(t *testing.T) {
+	for _, in := range []string{"0xdeadbeef", "0XDEADBEEF", "DEADBEEF", "deadbeef", "0xDeadBeef"} {
+		got, err := ParseHexFromString(in)
+		if err != nil || got != 0xdeadbeef {
+			t.Errorf("ParseHexFromString(%q) = %#x, %v, want 0xdeadbeef", in, got, err)
+		}
+	}
+	for _, in := range []string{"", "0x", "xyz", "0xdeadbeefdeadbeef0"} {
+		if got, err := ParseHexFromString(in); err == nil {
+			t.Errorf("ParseHexFromString(%q) = %#x, want an error", in, got)
+		}
+	}
+}
+
+func TestRawSerial(t *testing.T) {
+	const want = "AQIDBAUGBwg=" // 01 02 03 04 05 06 07 08
+	cfg0Raw, cfg1Raw := []byte{1, 2, 3, 4}, []byte{5, 6, 7, 8}
+
+	// The raw words win over values decoded in either byte order
+	if got := RawSerial(cfg0Raw, cfg1Raw, 0x01020304, 0x05060708); got != want {
+		t.Errorf("big-endian values: got %q, want %q", got, want)
+	}
+	if got := RawSerial(cfg0Raw, cfg1Raw, 0x04030201, 0x08070605); got != want {
+		t.Errorf("little-endian values: got %q, want %q", got, want)
+	}
+	// Halves from other sources are encoded like the NVMEM layout
+	if got := RawSerial(nil, nil, 0x04030201, 0x08070605); got != want {
+		t.Errorf("no raw words: got %q, want %q", got, want)
+	}
+	if got := RawSerial(cfg0Raw, nil, 0x01020304, 0x08070605); got != want {
+		t.Errorf("CFG1 without raw word: got %q, want %q", got, want)
+	}
+}